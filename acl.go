@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	// publicACL applies to every client of a public port and controlACL to
+	// the servers connecting to -addr. They change when the config is
+	// reloaded.
+	publicACL  atomic.Pointer[acl]
+	controlACL atomic.Pointer[acl]
+
+	// rejectedClients and rejectedServers count the connections refused by
+	// address.
+	rejectedClients atomic.Uint64
+	rejectedServers atomic.Uint64
+)
+
+// acl decides which addresses may connect. An address matching a deny rule is
+// refused. If there are allow rules, it also has to match one of them. A nil
+// acl lets everyone in.
+type acl struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parseACL returns the acl for the given rules, each a CIDR prefix or a single
+// address. It returns nil if there are no rules.
+func parseACL(allow, deny []string) (*acl, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &acl{}
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parseACLFlags is like parseACL for comma separated lists of rules.
+func parseACLFlags(allow, deny string) (*acl, error) {
+	return parseACL(splitList(allow), splitList(deny))
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parsePrefixes parses CIDR prefixes and single addresses.
+func parsePrefixes(rules []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(rules))
+	for _, rule := range rules {
+		if !strings.Contains(rule, "/") {
+			ip, err := netip.ParseAddr(rule)
+			if err != nil {
+				return nil, fmt.Errorf("bad address rule %q: %w", rule, err)
+			}
+			// A prefix can't have a zone.
+			ip = ip.Unmap().WithZone("")
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return nil, fmt.Errorf("bad address rule %q: %w", rule, err)
+		}
+		if p.Addr().Is4In6() {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits returns true if a connection from addr is let in.
+func (a *acl) permits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	// A zoned address never matches a prefix so drop the zone.
+	ip := ap.Addr().Unmap().WithZone("")
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admits returns true if the client at addr may connect to p. The relay's
+// rules, the service's and the server's all have to let it in.
+func (p *publicListener) admits(addr net.Addr) bool {
+	return publicACL.Load().permits(addr) &&
+		serviceSettings(p.service).acl.permits(addr) &&
+		p.acl.permits(addr)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	tests := []struct {
+		rules []string
+		want  []string
+		err   bool
+	}{
+		{rules: nil, want: []string{}},
+		{rules: []string{"192.0.2.1"}, want: []string{"192.0.2.1/32"}},
+		{rules: []string{"2001:db8::1"}, want: []string{"2001:db8::1/128"}},
+		{rules: []string{"10.1.2.3/8"}, want: []string{"10.0.0.0/8"}},
+		{rules: []string{"::ffff:192.0.2.1"}, want: []string{"192.0.2.1/32"}},
+		{rules: []string{"::ffff:10.0.0.0/104"}, want: []string{"10.0.0.0/8"}},
+		{rules: []string{"10.0.0.0/8", "192.0.2.1"}, want: []string{"10.0.0.0/8", "192.0.2.1/32"}},
+		{rules: []string{"example.com"}, err: true},
+		{rules: []string{"10.0.0.0/33"}, err: true},
+	}
+	for _, test := range tests {
+		got, err := parsePrefixes(test.rules)
+		if test.err {
+			if err == nil {
+				t.Errorf("parsePrefixes(%q) = %v, want an error", test.rules, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePrefixes(%q): %v", test.rules, err)
+			continue
+		}
+		strs := make([]string, 0, len(got))
+		for _, p := range got {
+			strs = append(strs, p.String())
+		}
+		if !slices.Equal(strs, test.want) {
+			t.Errorf("parsePrefixes(%q) = %v, want %v", test.rules, strs, test.want)
+		}
+	}
+}
+
+func TestPermits(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		addr        string
+		want        bool
+	}{
+		{"no rules", nil, nil, "192.0.2.1", true},
+		{"empty lists", []string{}, []string{}, "192.0.2.1", true},
+		{"denied address", nil, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"other address", nil, []string{"192.0.2.1"}, "192.0.2.2", true},
+		{"denied prefix", nil, []string{"192.0.2.0/24"}, "192.0.2.200", false},
+		{"allowed prefix", []string{"10.0.0.0/8"}, nil, "10.9.8.7", true},
+		{"not allowed", []string{"10.0.0.0/8"}, nil, "192.0.2.1", false},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.1", false},
+		{"allowed next to denied", []string{"10.0.0.0/8"}, []string{"10.0.0.1"}, "10.0.0.2", true},
+		{"mapped client", nil, []string{"192.0.2.0/24"}, "::ffff:192.0.2.1", false},
+		{"mapped rule", []string{"::ffff:192.0.2.1"}, nil, "192.0.2.1", true},
+		{"IPv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"IPv4 against IPv6 rules", []string{"2001:db8::/32"}, nil, "192.0.2.1", false},
+		{"zoned client", nil, []string{"fe80::/10"}, "fe80::1%eth0", false},
+		{"zoned client allowed", []string{"fe80::/10"}, nil, "fe80::1%eth0", true},
+		{"zoned rule", nil, []string{"fe80::1%eth1"}, "fe80::1%eth0", false},
+	}
+	for _, test := range tests {
+		a, err := parseACL(test.allow, test.deny)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		addr := net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(test.addr), 1234))
+		if got := a.permits(addr); got != test.want {
+			t.Errorf("%v: permits(%v) = %v, want %v", test.name, addr, got, test.want)
+		}
+	}
+}
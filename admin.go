@@ -0,0 +1,251 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serverInfo is what the admin API shows about a server.
+type serverInfo struct {
+	ID         uint64         `json:"id"`
+	RemoteAddr string         `json:"remote_addr"`
+	Identity   string         `json:"identity,omitempty"`
+	Started    time.Time      `json:"started"`
+	Uptime     float64        `json:"uptime_seconds"`
+	Resuming   bool           `json:"resuming"`
+	Draining   bool           `json:"draining"`
+	Listeners  []listenerInfo `json:"listeners"`
+	Clients    int            `json:"clients"`
+}
+
+// listenerInfo is what the admin API shows about a public listener.
+type listenerInfo struct {
+	ID      uint32 `json:"id"`
+	Addr    string `json:"addr"`
+	Port    int    `json:"port,omitempty"`
+	Service string `json:"service,omitempty"`
+	Host    string `json:"host,omitempty"`
+	TLS     bool   `json:"tls"`
+}
+
+// clientInfo is what the admin API shows about a client.
+type clientInfo struct {
+	ID         uint32    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Listener   uint32    `json:"listener"`
+	Connected  time.Time `json:"connected"`
+	FromClient uint64    `json:"bytes_from_client"`
+	ToClient   uint64    `json:"bytes_to_client"`
+}
+
+// portsInfo is what the admin API shows about the port range.
+type portsInfo struct {
+	Addr string `json:"addr"`
+	Low  int    `json:"low"`
+	High int    `json:"high"`
+	Used []int  `json:"used"`
+}
+
+// serveAdmin serves the admin API on l until it's closed.
+//
+//	GET    /servers                    the servers we're relaying for
+//	GET    /servers/ID                 one of them
+//	DELETE /servers/ID                 disconnect it
+//	GET    /servers/ID/clients         its clients
+//	DELETE /servers/ID/clients/STREAM  disconnect one of them
+//	GET    /ports                      the port range and the ports in use
+//	DELETE /ports/PORT                 release the port
+//	GET    /metrics                    the metrics in the Prometheus text format
+func serveAdmin(l net.Listener) {
+	if err := http.Serve(l, http.HandlerFunc(routeAdmin)); err != nil {
+		slog.Error("serving the admin API", "err", err)
+	}
+}
+
+// routeAdmin hands the request to the admin handler for its method and path.
+func routeAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + parts[0]
+	if len(parts) > 1 {
+		route += "/ID"
+	}
+	if len(parts) > 2 {
+		route += "/" + parts[2]
+	}
+	if len(parts) > 3 {
+		route += "/ID"
+	}
+	if len(parts) > 4 {
+		route += "/..."
+	}
+	switch route {
+	case "GET servers":
+		adminServers(w, r)
+	case "GET servers/ID":
+		withServer(parts[1], w, func(s *server) { writeJSON(w, s.info()) })
+	case "DELETE servers/ID":
+		withServer(parts[1], w, func(s *server) { adminCloseServer(w, s) })
+	case "GET servers/ID/clients":
+		withServer(parts[1], w, func(s *server) { adminClients(w, s) })
+	case "DELETE servers/ID/clients/ID":
+		withServer(parts[1], w, func(s *server) { adminCloseClient(w, s, parts[3]) })
+	case "GET metrics":
+		serveMetrics(w, r)
+	case "GET ports":
+		adminPorts(w, r)
+	case "DELETE ports/ID":
+		adminReleasePort(w, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// withServer calls h with the server with the given ID.
+func withServer(id string, w http.ResponseWriter, h func(*server)) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		http.Error(w, "bad server ID", http.StatusBadRequest)
+		return
+	}
+	s := findServer(n)
+	if s == nil {
+		http.Error(w, "no such server", http.StatusNotFound)
+		return
+	}
+	h(s)
+}
+
+// writeJSON writes v as the response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		slog.Debug("writing admin response", "err", err)
+	}
+}
+
+func adminServers(w http.ResponseWriter, r *http.Request) {
+	all := allServers()
+	infos := make([]serverInfo, 0, len(all))
+	for _, s := range all {
+		infos = append(infos, s.info())
+	}
+	slices.SortFunc(infos, func(a, b serverInfo) int { return cmp.Compare(a.ID, b.ID) })
+	writeJSON(w, infos)
+}
+
+func adminCloseServer(w http.ResponseWriter, s *server) {
+	s.log.Info("disconnected by the admin API")
+	s.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminClients(w http.ResponseWriter, s *server) {
+	clients := s.allClients()
+	infos := make([]clientInfo, 0, len(clients))
+	for _, c := range clients {
+		infos = append(infos, c.info())
+	}
+	slices.SortFunc(infos, func(a, b clientInfo) int { return cmp.Compare(a.ID, b.ID) })
+	writeJSON(w, infos)
+}
+
+func adminCloseClient(w http.ResponseWriter, s *server, stream string) {
+	id, err := strconv.ParseUint(stream, 10, 32)
+	if err != nil {
+		http.Error(w, "bad client ID", http.StatusBadRequest)
+		return
+	}
+	c := s.getClient(uint32(id))
+	if c == nil {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	c.log.Info("disconnected by the admin API")
+	// The server is told the client went away.
+	c.abort()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func adminPorts(w http.ResponseWriter, r *http.Request) {
+	addr, low, high := portRange()
+	writeJSON(w, portsInfo{Addr: addr, Low: low, High: high, Used: usedPortList()})
+}
+
+// adminReleasePort disconnects the servers listening on the port, which
+// releases it. A port nobody is listening on is released right away.
+func adminReleasePort(w http.ResponseWriter, s string) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		http.Error(w, "bad port", http.StatusBadRequest)
+		return
+	}
+	var found []*server
+	for _, s := range allServers() {
+		for _, p := range s.publicListeners() {
+			if p.publicPort() == port {
+				found = append(found, s)
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		releasePort(port)
+		slog.Info("port released by the admin API", "port", port)
+	}
+	for _, s := range found {
+		s.log.Info("disconnected by the admin API to release a port", "released", port)
+		s.Close()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// info returns what the admin API shows about the server.
+func (s *server) info() serverInfo {
+	info := serverInfo{
+		ID:         s.id,
+		RemoteAddr: s.currentLink().conn.RemoteAddr().String(),
+		Identity:   s.identity,
+		Started:    s.started,
+		Uptime:     time.Since(s.started).Seconds(),
+	}
+	s.linkCond.L.Lock()
+	info.Resuming = s.parked
+	s.linkCond.L.Unlock()
+	for _, p := range s.publicListeners() {
+		info.Listeners = append(info.Listeners, listenerInfo{
+			ID:      p.id,
+			Addr:    p.addr,
+			Port:    p.publicPort(),
+			Service: p.service,
+			Host:    p.host,
+			TLS:     p.tlsConfig != nil,
+		})
+	}
+	slices.SortFunc(info.Listeners, func(a, b listenerInfo) int { return cmp.Compare(a.ID, b.ID) })
+	s.lock.Lock()
+	info.Draining = s.draining
+	info.Clients = len(s.clients)
+	s.lock.Unlock()
+	return info
+}
+
+// info returns what the admin API shows about the client.
+func (c *client) info() clientInfo {
+	return clientInfo{
+		ID:         c.id,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Listener:   c.listener,
+		Connected:  c.connected,
+		FromClient: c.fromClient.Load(),
+		ToClient:   c.toClient.Load(),
+	}
+}
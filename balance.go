@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// These are the ways clients can be spread across the servers of a service.
+const (
+	balanceRoundRobin = "round-robin"
+	balanceLeastConn  = "least-conn"
+	balanceRandom     = "random"
+)
+
+var (
+	// balance is how clients are spread across the servers of a service. It's
+	// guarded by poolLock once we're running.
+	balance = balanceRoundRobin
+
+	// pools are the ports shared by the servers of a service by the service's
+	// name.
+	pools    = map[string]*pool{}
+	poolLock = sync.Mutex{}
+)
+
+// parseBalance parses the balance command-line argument.
+func parseBalance(s string) error {
+	if err := checkBalance(s); err != nil {
+		return err
+	}
+	balance = s
+	return nil
+}
+
+// checkBalance returns an error if s isn't a way to spread clients.
+func checkBalance(s string) error {
+	switch s {
+	case balanceRoundRobin, balanceLeastConn, balanceRandom:
+		return nil
+	}
+	return fmt.Errorf("must be %v, %v or %v", balanceRoundRobin, balanceLeastConn, balanceRandom)
+}
+
+// currentBalance returns how clients are spread across the servers of a
+// service unless its config says otherwise.
+func currentBalance() string {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	return balance
+}
+
+// setBalance changes how clients are spread across the servers of a service.
+func setBalance(s string) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	balance = s
+}
+
+// pool is the public port of a service. Every server registered under the
+// service gets a member of the pool and new clients are spread across them.
+// The port is released once the last one leaves.
+type pool struct {
+	service  string
+	identity string
+	port     int
+	addr     string
+	listener net.Listener
+
+	// members and next are guarded by poolLock. next is the member round robin
+	// picks next.
+	members []*poolMember
+	next    int
+}
+
+// poolMember is a net.Listener for the clients the pool gives to one server.
+type poolMember struct {
+	pool      *pool
+	conns     chan net.Conn
+	close     chan struct{}
+	closeOnce sync.Once
+	// active is how many of the clients given to the member are still
+	// connected.
+	active atomic.Int64
+	// paused is set while the member's server is away resuming. It only gets
+	// clients if every member is.
+	paused atomic.Bool
+}
+
+// joinPool returns a member of the pool for service or nil if there's no
+// pool. port is the one the server with the given identity asked for, if any,
+// and fallback whether it takes another one. A service only has one pool, so
+// a *relay.Error is returned if the server can't join it.
+func joinPool(service, identity string, port int, fallback bool) (*poolMember, error) {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	p := pools[service]
+	if p == nil {
+		return nil, nil
+	}
+	if p.identity != identity {
+		return nil, &relay.Error{
+			Code:   relay.ErrorCodePortInUse,
+			Reason: fmt.Sprintf("service %v belongs to another identity", service),
+		}
+	}
+	if port != 0 && port != p.port && !fallback {
+		return nil, &relay.Error{
+			Code:   relay.ErrorCodePortInUse,
+			Reason: fmt.Sprintf("service %v is on port %v", service, p.port),
+		}
+	}
+	return p.add(), nil
+}
+
+// newPool starts spreading the clients of l, the listener on port at addr,
+// across the servers of service and returns a member for the first one. It
+// returns nil if another server of the service beat us to it.
+func newPool(service, identity string, port int, addr string, l net.Listener) *poolMember {
+	p := &pool{service: service, identity: identity, port: port, addr: addr, listener: l}
+	poolLock.Lock()
+	if pools[service] != nil {
+		poolLock.Unlock()
+		return nil
+	}
+	pools[service] = p
+	m := p.add()
+	poolLock.Unlock()
+	go p.serve()
+	return m
+}
+
+// add adds a member to the pool. poolLock has to be held.
+func (p *pool) add() *poolMember {
+	m := &poolMember{
+		pool:  p,
+		conns: make(chan net.Conn),
+		close: make(chan struct{}),
+	}
+	p.members = append(p.members, m)
+	return m
+}
+
+// pick returns the member the next client should go to or nil if there are
+// none left.
+func (p *pool) pick() *poolMember {
+	poolLock.Lock()
+	defer poolLock.Unlock()
+	members := make([]*poolMember, 0, len(p.members))
+	for _, m := range p.members {
+		if !m.paused.Load() {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		members = p.members
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	mode := balance
+	if sc := serviceSettings(p.service); sc.Balance != "" {
+		mode = sc.Balance
+	}
+	switch mode {
+	case balanceLeastConn:
+		m := members[0]
+		for _, o := range members[1:] {
+			if o.active.Load() < m.active.Load() {
+				m = o
+			}
+		}
+		return m
+	case balanceRandom:
+		return members[rand.IntN(len(members))]
+	}
+	p.next %= len(members)
+	m := members[p.next]
+	p.next++
+	return m
+}
+
+// serve accepts clients on the pool's port and hands each one to a member.
+func (p *pool) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			// The listener is closed when the last member leaves.
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("accepting clients", "service", p.service, "port", p.port, "err", err)
+			}
+			return
+		}
+		go p.hand(conn)
+	}
+}
+
+// hand gives conn to a member. If the member leaves before taking it, another
+// one is tried.
+func (p *pool) hand(conn net.Conn) {
+	for {
+		m := p.pick()
+		if m == nil {
+			conn.Close()
+			return
+		}
+		m.active.Add(1)
+		select {
+		case m.conns <- &pooledConn{Conn: conn, member: m}:
+			return
+		case <-m.close:
+			m.active.Add(-1)
+		}
+	}
+}
+
+// Accept implements the net.Listener interface.
+func (m *poolMember) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.close:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements the net.Listener interface. The member leaves the pool and
+// if it was the last one, the port is closed and released.
+func (m *poolMember) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.close)
+		p := m.pool
+		poolLock.Lock()
+		for i, o := range p.members {
+			if o == m {
+				p.members = append(p.members[:i], p.members[i+1:]...)
+				break
+			}
+		}
+		last := len(p.members) == 0
+		if last && pools[p.service] == p {
+			delete(pools, p.service)
+		}
+		poolLock.Unlock()
+		if last {
+			p.listener.Close()
+			releasePort(p.port)
+		}
+	})
+	return nil
+}
+
+// Addr implements the net.Listener interface. It returns the pool's port.
+func (m *poolMember) Addr() net.Addr {
+	return m.pool.listener.Addr()
+}
+
+// pooledConn is a client given to a pool member. It counts as active for the
+// member until it's closed.
+type pooledConn struct {
+	net.Conn
+	member    *poolMember
+	closeOnce sync.Once
+}
+
+// Close implements the net.Conn interface.
+func (c *pooledConn) Close() error {
+	c.closeOnce.Do(func() { c.member.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the write side of the client so half-closing keeps
+// working.
+func (c *pooledConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// pauseMembers sets whether the server's pool members are paused.
+func (s *server) pauseMembers(paused bool) {
+	for _, p := range s.publicListeners() {
+		if m, ok := p.listener.(*poolMember); ok {
+			m.paused.Store(paused)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/icub3d/tcprelay/relay"
 )
@@ -11,71 +16,282 @@ import (
 // client is a connection from the other side of the relay. Clients connections
 // are made through the server struct.
 type client struct {
+	id     uint32
 	conn   net.Conn
 	server *server
-	closed bool
-	lock   sync.Mutex
 	wg     sync.WaitGroup
+	// listener is the ID of the public listener the client came through.
+	listener  uint32
+	connected time.Time
+	// fromClient and toClient count the bytes relayed each way.
+	fromClient atomic.Uint64
+	toClient   atomic.Uint64
+	// log carries the server's fields along with the stream ID and the
+	// client's address.
+	log *slog.Logger
+	// fromLimit and toLimit limit the bytes relayed each way for the client.
+	// done is closed once it's closed so nobody waits on them any longer.
+	fromLimit *limiter
+	toLimit   *limiter
+	done      chan struct{}
+
+	// cond guards and signals changes to everything below.
+	cond   *sync.Cond
+	closed bool
+	// credit is how many more bytes the server is willing to take from this
+	// client. It's only used when the server does flow control.
+	credit int
+	// out is the data waiting to be written to the client. Once it's drained,
+	// the client is closed if finish is set or its write side is shut down if
+	// finishWrite is set.
+	out         bytes.Buffer
+	finish      bool
+	finishWrite bool
 }
 
-// newClient creates a new client for the given net.Conn. It sends new data from
-// the client to the given channel. When the client should be closed from the
+// newClient creates a new client for the given net.Conn and stream ID that
+// came through the given listener. Once run() is started, it sends new data
+// from the client to the server. When the client should be closed from the
 // server side, Close() should be called.
-func newClient(conn net.Conn, server *server) *client {
-	c := &client{conn: conn, server: server}
-	go c.run()
-	return c
+func newClient(id uint32, conn net.Conn, server *server, listener uint32) *client {
+	return &client{
+		id:        id,
+		conn:      conn,
+		server:    server,
+		listener:  listener,
+		connected: time.Now(),
+		log:       server.log.With("stream", id, "client", conn.RemoteAddr().String()),
+		fromLimit: newLimiter(server.clientRate),
+		toLimit:   newLimiter(server.clientRate),
+		done:      make(chan struct{}),
+		cond:      sync.NewCond(&sync.Mutex{}),
+		credit:    int(server.peerWindow),
+	}
 }
 
-// String returns the LocalAddr/RemoteAddr for this server.
+// String returns the stream ID and LocalAddr/RemoteAddr for this client.
 func (c *client) String() string {
-	return fmt.Sprintf("[%v %v]", c.conn.LocalAddr().String(),
+	return fmt.Sprintf("[%v %v %v]", c.id, c.conn.LocalAddr().String(),
 		c.conn.RemoteAddr().String())
 }
 
-// Close disconnects the client connection.
+// Close disconnects the client connection immediately and waits for its
+// goroutines to finish.
 func (c *client) Close() error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.closed = true
-	err := c.conn.Close()
+	err := c.shutdown()
 	c.wg.Wait()
 	return err
 }
 
-// Send sends the given message to this client.
-func (c *client) Send(p []byte) error {
-	_, err := c.conn.Write(p)
-	return err
+// Finish closes the client once all the data sent to it has been written.
+func (c *client) Finish() {
+	c.cond.L.Lock()
+	c.finish = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// FinishWrite shuts down the write side of the client once all the data sent
+// to it has been written.
+func (c *client) FinishWrite() {
+	c.cond.L.Lock()
+	c.finishWrite = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// shutdown closes the client connection and removes it from the server without
+// waiting for anything.
+func (c *client) shutdown() error {
+	if !c.markClosed() {
+		return nil
+	}
+	c.server.removeClient(c.id)
+	return c.conn.Close()
+}
+
+// abort is like shutdown but is used when the client connection broke. The
+// server is told about it unless we were already closed.
+func (c *client) abort() {
+	if !c.markClosed() {
+		return
+	}
+	c.server.Send(&relay.Message{Type: relay.MessageTypeClose, ID: c.id})
+	c.server.removeClient(c.id)
+	c.conn.Close()
+}
+
+// markClosed marks the client as closed. It returns false if it already was.
+func (c *client) markClosed() bool {
+	c.cond.L.Lock()
+	if c.closed {
+		c.cond.L.Unlock()
+		return false
+	}
+	c.closed = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+	close(c.done)
+	clientDurations.observe(time.Since(c.connected).Seconds())
+	return true
+}
+
+// Send queues the given data to be written to this client. A server that does
+// flow control never sends more than we have room for. For
+// one that doesn't, Send waits while a window's worth is queued so the server
+// feels the back pressure instead of the client losing data.
+func (c *client) Send(p []byte) {
+	c.cond.L.Lock()
+	for c.out.Len() > 0 && c.out.Len()+len(p) > int(window) && !c.closed {
+		c.cond.Wait()
+	}
+	// The server shouldn't send anything after shutting down writes.
+	if !c.closed && !c.finishWrite {
+		c.out.Write(p)
+	}
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// Grant gives the client n more bytes of credit to send to the server.
+func (c *client) Grant(n uint32) {
+	c.cond.L.Lock()
+	c.credit += int(n)
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// start starts the goroutines reading from and writing to the client.
+func (c *client) start() {
+	c.wg.Add(2)
+	go c.run()
+	go c.write()
 }
 
+// run reads from the client and sends it to the server. When the server does
+// flow control, it stops reading when we're out of credit so the client feels
+// the back pressure. When the server supports half-closed connections and the
+// client shuts down its write side, the server is told and run returns while
+// the client can still be written to.
 func (c *client) run() {
-	c.wg.Add(1)
 	defer c.wg.Done()
+	flow := c.server.caps.Has(relay.CapabilityFlowControl)
+	halfClose := c.server.caps.Has(relay.CapabilityHalfClose)
+	buf := make([]byte, 4096)
 	for {
+		// Wait until we can send something.
+		n := chunk(len(buf), c.fromLimit, c.server.fromLimit, fromClientsLimit)
+		if flow {
+			c.cond.L.Lock()
+			for c.credit < 1 && !c.closed {
+				c.cond.Wait()
+			}
+			if c.closed {
+				c.cond.L.Unlock()
+				return
+			}
+			if c.credit < n {
+				n = c.credit
+			}
+			c.cond.L.Unlock()
+		}
 		// Read a message.
-		buf := make([]byte, 4096)
-		n, err := c.conn.Read(buf)
-		msg := &relay.Message{
-			RemoteAddr: c.conn.RemoteAddr().String(),
-			LocalAddr:  c.conn.LocalAddr().String(),
+		n, err := c.conn.Read(buf[:n])
+		msg := &relay.Message{ID: c.id}
+		if err == io.EOF && halfClose {
+			msg.Type = relay.MessageTypeCloseWrite
+			c.server.Send(msg)
+			return
 		}
 		if err != nil {
 			// If we didn't close via Close(), we should signal the server and then
-			// Close() ourselves.
-			closed := false
-			c.lock.Lock()
-			closed = c.closed
-			c.lock.Unlock()
-			if !closed {
-				msg.Type = relay.MessageTypeClose
-				c.server.Send(msg)
-			}
+			// close ourselves.
+			c.abort()
+			return
+		}
+		// Hold off on reading more until the limits allow for what we read.
+		if !throttle(c.done, &throttledFromClients, n, c.fromLimit, c.server.fromLimit, fromClientsLimit) {
 			return
 		}
+		c.fromClient.Add(uint64(n))
+		bytesFromClients.Add(uint64(n))
+		if flow {
+			c.cond.L.Lock()
+			c.credit -= n
+			c.cond.L.Unlock()
+		}
 		// Send the data to the server.
 		msg.Type = relay.MessageTypeData
-		msg.Data = buf[:n]
-		c.server.Send(msg)
+		msg.Data = make([]byte, n)
+		copy(msg.Data, buf)
+		if !c.server.Send(msg) {
+			return
+		}
+	}
+}
+
+// write writes the data queued by Send to the client. It waits on the rate
+// limits here rather than in Send so a limited client doesn't hold up the
+// server's others. When the server does flow control, it lets the server know
+// once we've made room for more.
+func (c *client) write() {
+	defer c.wg.Done()
+	flow := c.server.caps.Has(relay.CapabilityFlowControl)
+	buf := make([]byte, 32*1024)
+	written := 0
+	writeClosed := false
+	for {
+		c.cond.L.Lock()
+		for c.out.Len() == 0 && !c.finish && !c.closed &&
+			(!c.finishWrite || writeClosed) {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.cond.L.Unlock()
+			return
+		}
+		if c.out.Len() == 0 {
+			finish := c.finish
+			c.cond.L.Unlock()
+			if finish {
+				// We've been asked to finish and everything is written.
+				c.shutdown()
+				return
+			}
+			// The server is done writing so we are too.
+			writeClosed = true
+			if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+				if err := cw.CloseWrite(); err != nil {
+					c.abort()
+					return
+				}
+			}
+			continue
+		}
+		n, _ := c.out.Read(buf[:chunk(len(buf), c.toLimit, c.server.toLimit, toClientsLimit)])
+		c.cond.L.Unlock()
+		// Let Send know there's room.
+		c.cond.Broadcast()
+		if !throttle(c.done, &throttledToClients, n, c.toLimit, c.server.toLimit, toClientsLimit) {
+			return
+		}
+		if _, err := c.conn.Write(buf[:n]); err != nil {
+			c.abort()
+			return
+		}
+		c.toClient.Add(uint64(n))
+		bytesToClients.Add(uint64(n))
+		// Batch up the window updates instead of sending one per write.
+		// Granting at half the window gives the server its credit back
+		// before it runs out, so it never sits idle waiting on us.
+		written += n
+		if flow && written >= int(window)/2 {
+			c.server.Send(&relay.Message{
+				Type:   relay.MessageTypeWindow,
+				ID:     c.id,
+				Window: uint32(written),
+			})
+			written = 0
+		}
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// testClient starts a client for a server with the given capabilities and
+// window that isn't connected to anything. Messages the client sends to the
+// server show up on s.toServer. It returns the other end of the client's
+// connection.
+func testClient(t *testing.T, caps relay.Capabilities, peerWindow uint32) (*server, *client, net.Conn) {
+	t.Helper()
+	s := &server{
+		caps:       caps,
+		peerWindow: peerWindow,
+		clients:    make(map[uint32]*client),
+		toServer:   make(chan *relay.Message),
+		close:      make(chan struct{}),
+		drained:    make(chan struct{}),
+		log:        slog.Default(),
+	}
+	conn, other := net.Pipe()
+	c := newClient(1, conn, s, 0)
+	s.clients[c.id] = c
+	c.start()
+	t.Cleanup(func() {
+		close(s.close)
+		c.Close()
+		other.Close()
+	})
+	return s, c, other
+}
+
+func TestSlowClientGetsEverything(t *testing.T) {
+	defer func(w uint32) { window = w }(window)
+	window = 16 * 1024
+	s, c, conn := testClient(t, nil, 0)
+	go func() {
+		for {
+			select {
+			case msg := <-s.toServer:
+				if msg.Type == relay.MessageTypeClose {
+					t.Error("client closed")
+				}
+			case <-s.close:
+				return
+			}
+		}
+	}()
+
+	// The server sends much more than the window while the client reads
+	// slowly. Nothing may be lost.
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for p := data; len(p) > 0; p = p[min(len(p), 8*1024):] {
+			c.Send(p[:min(len(p), 8*1024)])
+		}
+		c.Finish()
+	}()
+	var got bytes.Buffer
+	buf := make([]byte, 4*1024)
+	for {
+		n, err := conn.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("client got %v of %v bytes", got.Len(), len(data))
+	}
+}
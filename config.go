@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"sync/atomic"
+)
+
+var (
+	// commandLine are the flags given on the command line. They win over the
+	// config file.
+	commandLine = map[string]bool{}
+
+	// started are the flag values the config file gave when we started. A
+	// reload that changes one that can't be reloaded only gets a warning.
+	started = map[string]string{}
+
+	// base are the reloadable settings as the command line and defaults give
+	// them, by flag name.
+	base = map[string]string{}
+
+	// serviceConfigs are the per-service settings from the config file by
+	// service name.
+	serviceConfigs atomic.Pointer[map[string]serviceConfig]
+)
+
+// reloadable are the flags a reload applies to new connections. The others
+// only change on a restart.
+var reloadable = map[string]bool{
+	"ports":     true,
+	"tokens":    true,
+	"balance":   true,
+	"log-level": true,
+
+	"allow":         true,
+	"deny":          true,
+	"control-allow": true,
+	"control-deny":  true,
+
+	"rate":        true,
+	"server-rate": true,
+	"client-rate": true,
+}
+
+// rememberBase records the reloadable settings before the config file is
+// applied.
+func rememberBase() {
+	for name := range reloadable {
+		base[name] = flag.Lookup(name).Value.String()
+	}
+}
+
+// setting is a flag.Value for a setting applied by set. Unlike flag.Func, it
+// remembers what it was set to.
+type setting struct {
+	value string
+	set   func(string) error
+}
+
+// String implements the flag.Value interface.
+func (v *setting) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+// Set implements the flag.Value interface.
+func (v *setting) Set(s string) error {
+	if err := v.set(s); err != nil {
+		return err
+	}
+	v.value = s
+	return nil
+}
+
+// config is what a -config file holds. It's a JSON object whose keys are the
+// names of the flags, e.g. {"ports": ":8001-9000", "keepalive": "30s"}, along
+// with identities and services.
+type config struct {
+	flags map[string]string
+	// identities are secrets servers can authenticate with by identity on top
+	// of the ones in the tokens file.
+	identities map[string]string
+	services   map[string]serviceConfig
+}
+
+// serviceConfig holds the settings for the servers registering a service.
+type serviceConfig struct {
+	// Port is the port the service always gets. It's never picked for a
+	// server that didn't ask for it.
+	Port int `json:"port"`
+	// Balance overrides -balance for the service.
+	Balance string `json:"balance"`
+	// Allow and Deny are rules for who may connect to the service on top of
+	// -allow and -deny.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// ServerRate and ClientRate are limits in bytes per second for its
+	// servers and their clients on top of -server-rate and -client-rate.
+	ServerRate uint64 `json:"server_rate"`
+	ClientRate uint64 `json:"client_rate"`
+
+	acl *acl
+}
+
+// loadConfig reads and checks the config file at path.
+func loadConfig(path string) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	cfg := &config{flags: make(map[string]string)}
+	for name, v := range raw {
+		switch name {
+		case "identities":
+			err = json.Unmarshal(v, &cfg.identities)
+		case "services":
+			err = json.Unmarshal(v, &cfg.services)
+		default:
+			if name == "config" || flag.Lookup(name) == nil {
+				return nil, fmt.Errorf("%v: unknown setting %q", path, name)
+			}
+			// Strings are unquoted, everything else is taken as written.
+			var s string
+			if err = json.Unmarshal(v, &s); err != nil {
+				s, err = string(bytes.TrimSpace(v)), nil
+			}
+			cfg.flags[name] = s
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v: %w", path, name, err)
+		}
+	}
+	for name, sc := range cfg.services {
+		if sc.Balance != "" {
+			if err := checkBalance(sc.Balance); err != nil {
+				return nil, fmt.Errorf("%v: service %q: balance %w", path, name, err)
+			}
+		}
+		if sc.acl, err = parseACL(sc.Allow, sc.Deny); err != nil {
+			return nil, fmt.Errorf("%v: service %q: %w", path, name, err)
+		}
+		cfg.services[name] = sc
+	}
+	return cfg, nil
+}
+
+// applyConfig sets the flags the config file at path gives that weren't given
+// on the command line. It's only used when starting.
+func applyConfig(path string) (*config, error) {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range cfg.flags {
+		if commandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return nil, fmt.Errorf("%v: %v: %w", path, name, err)
+		}
+		started[name] = v
+	}
+	serviceConfigs.Store(&cfg.services)
+	return cfg, nil
+}
+
+// reloadConfig rereads the config file at path, if any, and the tokens file.
+// The reloadable settings start over from base so one taken out of the file
+// goes back to what it was without it. Everything is checked before anything
+// changes so a bad file changes nothing. The changes only apply to new
+// connections.
+func reloadConfig(path string) error {
+	cfg := &config{}
+	if path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return err
+		}
+	}
+	values := maps.Clone(base)
+	for name, v := range cfg.flags {
+		if commandLine[name] {
+			continue
+		}
+		if !reloadable[name] {
+			if v != started[name] {
+				slog.Warn("setting needs a restart to change", "setting", name)
+			}
+			continue
+		}
+		values[name] = v
+	}
+	set, err := parseSettings(values, cfg.identities)
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	if set.tokens == nil && tokens.Load() != nil {
+		return errors.New("refusing to turn off authentication without a restart")
+	}
+	set.apply()
+	serviceConfigs.Store(&cfg.services)
+	return nil
+}
+
+// settings are the reloadable settings, checked and ready to apply.
+type settings struct {
+	portAddr          string
+	portLow, portHigh int
+	tokenPath         string
+	tokens            *tokenStore
+	balance           string
+	level             slog.Level
+	public, control   *acl
+	rate              uint64
+	serverRate        uint64
+	clientRate        uint64
+}
+
+// parseSettings checks the reloadable settings in values, which are keyed by
+// flag name, and loads the tokens file along with identities.
+func parseSettings(values map[string]string, identities map[string]string) (*settings, error) {
+	set := &settings{tokenPath: values["tokens"], balance: values["balance"]}
+	var err error
+	if set.portAddr, set.portLow, set.portHigh, err = parsePorts(values["ports"]); err != nil {
+		return nil, fmt.Errorf("ports: %w", err)
+	}
+	if err := checkBalance(set.balance); err != nil {
+		return nil, fmt.Errorf("balance: %w", err)
+	}
+	if err := set.level.UnmarshalText([]byte(values["log-level"])); err != nil {
+		return nil, fmt.Errorf("log-level: %w", err)
+	}
+	if set.public, err = parseACLFlags(values["allow"], values["deny"]); err != nil {
+		return nil, fmt.Errorf("allow or deny: %w", err)
+	}
+	if set.control, err = parseACLFlags(values["control-allow"], values["control-deny"]); err != nil {
+		return nil, fmt.Errorf("control-allow or control-deny: %w", err)
+	}
+	for name, rate := range map[string]*uint64{
+		"rate":        &set.rate,
+		"server-rate": &set.serverRate,
+		"client-rate": &set.clientRate,
+	} {
+		if *rate, err = parseRate(values[name]); err != nil {
+			return nil, fmt.Errorf("%v: %w", name, err)
+		}
+	}
+	if set.tokens, err = buildTokens(set.tokenPath, identities); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// apply puts the settings in place for new connections.
+func (set *settings) apply() {
+	setPortRange(set.portAddr, set.portLow, set.portHigh)
+	tokenFile = set.tokenPath
+	if set.tokens != nil {
+		set.tokens.keepSeen(tokens.Load())
+		tokens.Store(set.tokens)
+	}
+	setBalance(set.balance)
+	logLevel.Set(set.level)
+	publicACL.Store(set.public)
+	controlACL.Store(set.control)
+	fromClientsLimit.setRate(set.rate)
+	toClientsLimit.setRate(set.rate)
+	serverRate.Store(set.serverRate)
+	clientRate.Store(set.clientRate)
+}
+
+// serviceSettings returns the config file's settings for the service.
+func serviceSettings(service string) serviceConfig {
+	if m := serviceConfigs.Load(); m != nil {
+		return (*m)[service]
+	}
+	return serviceConfig{}
+}
+
+// reservedPorts returns the ports the config file keeps for services.
+func reservedPorts() map[int]bool {
+	reserved := map[int]bool{}
+	if m := serviceConfigs.Load(); m != nil {
+		for _, sc := range *m {
+			if sc.Port != 0 {
+				reserved[sc.Port] = true
+			}
+		}
+	}
+	return reserved
+}
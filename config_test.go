@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfigRevertsRemovedSettings(t *testing.T) {
+	rememberBase()
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(s string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadConfig(path); err != nil {
+			t.Fatalf("reloading %v: %v", s, err)
+		}
+	}
+	client := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+
+	write(`{"deny": "127.0.0.1", "control-allow": "10.0.0.0/8", "client-rate": "1k",
+		"rate": "2k", "balance": "random", "log-level": "debug", "ports": ":9001-9002"}`)
+	if publicACL.Load().permits(client) {
+		t.Error("deny rule not applied")
+	}
+	if controlACL.Load().permits(client) {
+		t.Error("control-allow rule not applied")
+	}
+	if got := clientRate.Load(); got != 1024 {
+		t.Errorf("client rate is %v, want 1024", got)
+	}
+	if got := fromClientsLimit.limit(); got != 2048 {
+		t.Errorf("rate is %v, want 2048", got)
+	}
+	if got := currentBalance(); got != balanceRandom {
+		t.Errorf("balance is %v, want %v", got, balanceRandom)
+	}
+	if got := logLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("log level is %v, want debug", got)
+	}
+	if _, low, high := portRange(); low != 9001 || high != 9002 {
+		t.Errorf("port range is %v-%v, want 9001-9002", low, high)
+	}
+
+	write(`{}`)
+	if !publicACL.Load().permits(client) || !controlACL.Load().permits(client) {
+		t.Error("removed address rules still applied")
+	}
+	if got := clientRate.Load(); got != 0 {
+		t.Errorf("client rate is %v after removing it", got)
+	}
+	if got := fromClientsLimit.limit(); got != 0 {
+		t.Errorf("rate is %v after removing it", got)
+	}
+	if got := currentBalance(); got != balanceRoundRobin {
+		t.Errorf("balance is %v after removing it", got)
+	}
+	if got := logLevel.Level(); got != slog.LevelInfo {
+		t.Errorf("log level is %v after removing it", got)
+	}
+	if _, low, high := portRange(); low != 8001 || high != 9000 {
+		t.Errorf("port range is %v-%v after removing it", low, high)
+	}
+}
+
+func TestReloadConfigKeepsSettingsOnError(t *testing.T) {
+	rememberBase()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"client-rate": "1k"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"client-rate": "fast", "deny": "127.0.0.1"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(path); err == nil {
+		t.Fatal("bad rate accepted")
+	}
+	if got := clientRate.Load(); got != 1024 {
+		t.Errorf("client rate is %v after a bad reload, want 1024", got)
+	}
+	if publicACL.Load() != nil {
+		t.Error("deny rule applied from a bad reload")
+	}
+}
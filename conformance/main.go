@@ -0,0 +1,105 @@
+// Program conformance checks a relay or server implementation against the
+// tcprelay protocol specification.
+//
+// With -relay, it connects to a relay as a server and checks how the relay
+// handles it and the clients conformance connects through it. With -listen,
+// it acts as a relay and waits for a server to connect. That server should
+// echo back whatever data it gets on a stream. Every message is also checked
+// against the specification in the relay package which -spec prints.
+package main
+
+//go:generate sh -c "go run . -spec > ../PROTOCOL.md"
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+var (
+	relayAddr  string
+	listenAddr string
+	codecName  string
+	token      string
+	useTLS     bool
+	timeout    time.Duration
+	printSpec  bool
+)
+
+func init() {
+	flag.StringVar(&relayAddr, "relay", "",
+		"the addr:port of a relay to test.")
+	flag.StringVar(&listenAddr, "listen", "",
+		"the addr:port to listen on for an echo server to test.")
+	flag.StringVar(&codecName, "codec", "json",
+		"the codec to use when testing a relay (json or binary).")
+	flag.StringVar(&token, "token", "",
+		"the bearer token to send when testing a relay that requires one.")
+	flag.BoolVar(&useTLS, "tls", false,
+		"use TLS, without verifying the certificate, when testing a relay.")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second,
+		"how long to wait for the implementation to respond.")
+	flag.BoolVar(&printSpec, "spec", false,
+		"print the protocol specification and exit.")
+}
+
+// scenario is a single scripted test. run returns errSkip if the
+// implementation doesn't support what the scenario needs.
+type scenario struct {
+	name string
+	run  func() error
+}
+
+var errSkip = errors.New("skipped")
+
+// runAll runs the scenarios in order and reports on each one. It returns false
+// if any of them failed.
+func runAll(scenarios []scenario) bool {
+	ok := true
+	for _, s := range scenarios {
+		switch err := s.run(); err {
+		case nil:
+			fmt.Printf("PASS %v\n", s.name)
+		case errSkip:
+			fmt.Printf("SKIP %v\n", s.name)
+		default:
+			fmt.Printf("FAIL %v: %v\n", s.name, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func main() {
+	flag.Parse()
+
+	if printSpec {
+		if err := relay.WriteSpec(os.Stdout); err != nil {
+			log.Fatalln("writing spec:", err)
+		}
+		return
+	}
+
+	var ok bool
+	switch {
+	case relayAddr != "":
+		codec, err := relay.CodecByName(codecName)
+		if err != nil {
+			log.Fatalln("parsing codec:", err)
+		}
+		ok = testRelay(relayAddr, codec)
+	case listenAddr != "":
+		ok = testServer(listenAddr)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,805 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// testRelay runs the scenarios for a relay at addr. We play the server and
+// connect clients through the relay.
+func testRelay(addr string, codec relay.Codec) bool {
+	r := &relayTest{addr: addr, codec: codec}
+	return runAll([]scenario{
+		{"hello json", func() error { return r.hello(relay.JSONCodec) }},
+		{"hello binary", func() error { return r.hello(relay.BinaryCodec) }},
+		{"unknown codec", r.unknownCodec},
+		{"hello required", r.helloRequired},
+		{"authentication", r.authentication},
+		{"version mismatch", r.versionMismatch},
+		{"connect and data", r.data},
+		{"client close", r.clientClose},
+		{"server close", r.serverClose},
+		{"half close", r.halfClose},
+		{"flow control", r.flowControl},
+		{"keepalive", r.keepAlive},
+		{"stop", r.stop},
+		{"register port", r.registerPort},
+		{"register service", r.registerService},
+		{"shared service", r.sharedService},
+		{"resume", r.resume},
+		{"resume unknown session", r.resumeUnknown},
+		{"listeners", r.listeners},
+		{"virtual host", r.virtualHost},
+		{"client address rules", r.clientRules},
+		{"rate limit", r.rateLimit},
+	})
+}
+
+type relayTest struct {
+	addr  string
+	codec relay.Codec
+}
+
+// start connects to the relay offering caps and returns the session and the
+// address clients can use.
+func (r *relayTest) start(codec relay.Codec, caps relay.Capabilities, window uint32) (*session, string, error) {
+	return r.register(codec, caps, window, &relay.Message{Type: relay.MessageTypeRegister})
+}
+
+// register is like start but sends reg if the relay agreed to register.
+func (r *relayTest) register(codec relay.Codec, caps relay.Capabilities, window uint32, reg *relay.Message) (*session, string, error) {
+	s, err := dialSession(r.addr, codec)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.hello(caps, window); err != nil {
+		s.Close()
+		return nil, "", err
+	}
+	for _, name := range caps {
+		if !s.check.Capabilities().Has(name) {
+			s.Close()
+			return nil, "", errSkip
+		}
+	}
+	if s.check.Capabilities().Has(relay.CapabilityRegister) {
+		if err := s.send(reg); err != nil {
+			s.Close()
+			return nil, "", err
+		}
+	}
+	msg, err := s.expect(relay.MessageTypeRelay)
+	if err != nil {
+		s.Close()
+		return nil, "", err
+	}
+	addr, err := r.clientAddr(msg)
+	if err != nil {
+		s.Close()
+		return nil, "", err
+	}
+	return s, addr, nil
+}
+
+// clientAddr returns the address clients can use from a relay message.
+func (r *relayTest) clientAddr(msg *relay.Message) (string, error) {
+	// The relay may only give us a port.
+	host, port, err := net.SplitHostPort(string(msg.Data))
+	if err != nil {
+		return "", fmt.Errorf("bad relay address %q: %w", msg.Data, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host, _, _ = net.SplitHostPort(r.addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// finish tells the relay we're done and waits for it to hang up.
+func (r *relayTest) finish(s *session) error {
+	defer s.Close()
+	if err := s.send(&relay.Message{Type: relay.MessageTypeStop}); err != nil {
+		return err
+	}
+	return s.expectEOF()
+}
+
+// connect connects a client through the relay and returns it along with its
+// stream ID.
+func (r *relayTest) connect(s *session, addr string) (*net.TCPConn, uint32, error) {
+	return r.connectTo(s, addr, 0)
+}
+
+// connectTo is like connect but for a client of the given listener.
+func (r *relayTest) connectTo(s *session, addr string, listener uint32) (*net.TCPConn, uint32, error) {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	msg, err := s.expect(relay.MessageTypeConnect)
+	if err != nil {
+		c.Close()
+		return nil, 0, err
+	}
+	if msg.Listener != listener {
+		c.Close()
+		return nil, 0, fmt.Errorf("client of listener %v came through %v", listener, msg.Listener)
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	return c.(*net.TCPConn), msg.ID, nil
+}
+
+func (r *relayTest) hello(codec relay.Codec) error {
+	s, _, err := r.start(codec, nil, 0)
+	if err != nil {
+		return err
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) unknownCodec() error {
+	c, err := net.DialTimeout("tcp", r.addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(c, "nope\n"); err != nil {
+		return err
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		return fmt.Errorf("connection wasn't closed: %w", err)
+	}
+	return nil
+}
+
+func (r *relayTest) helloRequired() error {
+	s, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.sendRaw(&relay.Message{Type: relay.MessageTypeData, ID: 1, Data: []byte("hi")})
+	if err != nil {
+		return err
+	}
+	msg, err := s.expect(relay.MessageTypeError)
+	if err != nil {
+		return err
+	}
+	if msg.Code != relay.ErrorCodeProtocol {
+		return fmt.Errorf("expected the %v error code, got %v", relay.ErrorCodeProtocol, msg.Code)
+	}
+	return s.expectEOF()
+}
+
+func (r *relayTest) authentication() error {
+	s, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.send(&relay.Message{
+		Type:    relay.MessageTypeHello,
+		Version: relay.ProtocolVersion,
+		Token:   "conformance-bad-token",
+	})
+	if err != nil {
+		return err
+	}
+	msg, err := s.recv()
+	if err != nil {
+		return err
+	}
+	switch {
+	case msg.Type == relay.MessageTypeHello:
+		// The relay lets anyone in.
+		return errSkip
+	case msg.Type != relay.MessageTypeError:
+		return fmt.Errorf("expected %v or %v, got %v", relay.MessageTypeHello, relay.MessageTypeError, msg)
+	case msg.Code != relay.ErrorCodeAuth:
+		return fmt.Errorf("expected the %v error code, got %v", relay.ErrorCodeAuth, msg.Code)
+	}
+	return s.expectEOF()
+}
+
+func (r *relayTest) versionMismatch() error {
+	s, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	err = s.send(&relay.Message{Type: relay.MessageTypeHello, Version: relay.ProtocolVersion + 1, Token: token})
+	if err != nil {
+		return err
+	}
+	if _, err := s.expect(relay.MessageTypeHello); err != nil {
+		return err
+	}
+	return s.expectEOF()
+}
+
+func (r *relayTest) data() error {
+	s, addr, err := r.start(r.codec, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		return err
+	}
+	if p, err := s.received(id, 5); err != nil {
+		return err
+	} else if string(p) != "hello" {
+		return fmt.Errorf("relay sent %q instead of %q", p, "hello")
+	}
+	if err := s.sendData(id, []byte("world")); err != nil {
+		return err
+	}
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return fmt.Errorf("reading from the client: %w", err)
+	}
+	if string(p) != "world" {
+		return fmt.Errorf("client got %q instead of %q", p, "world")
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) clientClose() error {
+	s, addr, err := r.start(r.codec, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	c.Close()
+	if err := s.until("close", func() bool { return s.closed[id] }); err != nil {
+		return err
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) serverClose() error {
+	s, addr, err := r.start(r.codec, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := s.sendData(id, []byte("bye")); err != nil {
+		return err
+	}
+	if err := s.send(&relay.Message{Type: relay.MessageTypeClose, ID: id}); err != nil {
+		return err
+	}
+	p, err := io.ReadAll(c)
+	if err != nil {
+		return fmt.Errorf("client wasn't closed: %w", err)
+	}
+	if string(p) != "bye" {
+		return fmt.Errorf("client got %q instead of %q", p, "bye")
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) halfClose() error {
+	s, addr, err := r.start(r.codec, relay.Capabilities{relay.CapabilityHalfClose}, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.CloseWrite()
+	if err := s.until("close write", func() bool { return s.writeClosed[id] }); err != nil {
+		return err
+	}
+	// The client should still hear from us.
+	if err := s.sendData(id, []byte("done")); err != nil {
+		return err
+	}
+	if err := s.send(&relay.Message{Type: relay.MessageTypeClose, ID: id}); err != nil {
+		return err
+	}
+	p, err := io.ReadAll(c)
+	if err != nil {
+		return fmt.Errorf("client wasn't closed: %w", err)
+	}
+	if string(p) != "done" {
+		return fmt.Errorf("client got %q instead of %q", p, "done")
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) flowControl() error {
+	const window = 1024
+	caps := relay.Capabilities{relay.CapabilityFlowControl, relay.CapabilityKeepAlive}
+	s, addr, err := r.start(r.codec, caps, window)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// The relay must stop at our window until we let it have more. The checker
+	// fails the scenario if it doesn't.
+	s.grant = false
+	if _, err := c.Write(make([]byte, 4*window)); err != nil {
+		return err
+	}
+	if _, err := s.received(id, window); err != nil {
+		return err
+	}
+	if err := s.ping(); err != nil {
+		return err
+	}
+	if err := s.send(&relay.Message{Type: relay.MessageTypeWindow, ID: id, Window: 3 * window}); err != nil {
+		return err
+	}
+	if _, err := s.received(id, 3*window); err != nil {
+		return err
+	}
+	s.grant = true
+	// The relay must give us more room as the client reads what we send.
+	p := make([]byte, 2*s.peer.Window)
+	rand.Read(p)
+	done := make(chan error, 1)
+	go func() {
+		q := make([]byte, len(p))
+		_, err := io.ReadFull(c, q)
+		if err == nil && !bytes.Equal(p, q) {
+			err = errors.New("client got different data")
+		}
+		done <- err
+	}()
+	if err := s.sendData(id, p); err != nil {
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) keepAlive() error {
+	s, _, err := r.start(r.codec, relay.Capabilities{relay.CapabilityKeepAlive}, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.ping(); err != nil {
+		return err
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) stop() error {
+	s, addr, err := r.start(r.codec, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, _, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := r.finish(s); err != nil {
+		return err
+	}
+	// The relay should have dropped our clients and given up the port.
+	if _, err := io.ReadAll(c); err != nil {
+		return fmt.Errorf("client wasn't closed: %w", err)
+	}
+	if c, err := net.DialTimeout("tcp", addr, timeout); err == nil {
+		c.Close()
+		return fmt.Errorf("%v still accepts clients", addr)
+	}
+	return nil
+}
+
+// port returns the port of an addr:port.
+func port(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
+
+func (r *relayTest) registerPort() error {
+	caps := relay.Capabilities{relay.CapabilityRegister}
+	reg := &relay.Message{Type: relay.MessageTypeRegister}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := r.finish(s); err != nil {
+		return err
+	}
+	// Now that it's free, we should get the same port back when we ask.
+	reg.Port, _ = strconv.Atoi(port(addr))
+	s, got, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if port(got) != port(addr) {
+		return fmt.Errorf("asked for port %v, got %v", reg.Port, got)
+	}
+	// A second server can't have it.
+	other, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	if err := other.hello(caps, 0); err != nil {
+		return err
+	}
+	if err := other.send(reg); err != nil {
+		return err
+	}
+	msg, err := other.expect(relay.MessageTypeError)
+	if err != nil {
+		return err
+	}
+	if msg.Code != relay.ErrorCodePortInUse {
+		return fmt.Errorf("expected the %v error code, got %v", relay.ErrorCodePortInUse, msg.Code)
+	}
+	if err := other.expectEOF(); err != nil {
+		return err
+	}
+	// Unless it's willing to take another one.
+	reg.Fallback = true
+	other, got, err = r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	if port(got) == port(addr) {
+		return fmt.Errorf("two servers got port %v", reg.Port)
+	}
+	if err := r.finish(other); err != nil {
+		return err
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) registerService() error {
+	caps := relay.Capabilities{relay.CapabilityRegister}
+	reg := &relay.Message{
+		Type:    relay.MessageTypeRegister,
+		Service: fmt.Sprintf("conformance-%d", time.Now().UnixNano()),
+	}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := r.finish(s); err != nil {
+		return err
+	}
+	s, got, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if port(got) != port(addr) {
+		return fmt.Errorf("service moved from %v to %v", addr, got)
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) sharedService() error {
+	caps := relay.Capabilities{relay.CapabilityRegister}
+	reg := &relay.Message{
+		Type:    relay.MessageTypeRegister,
+		Service: fmt.Sprintf("conformance-%d", time.Now().UnixNano()),
+	}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	other, got, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+	if port(got) != port(addr) {
+		return fmt.Errorf("servers of one service got ports %v and %v", port(addr), port(got))
+	}
+	// Once one is gone, the port stays open for the other.
+	if err := r.finish(s); err != nil {
+		return err
+	}
+	c, id, err := r.connect(other, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		return err
+	}
+	if _, err := other.received(id, 5); err != nil {
+		return err
+	}
+	return r.finish(other)
+}
+
+func (r *relayTest) resume() error {
+	caps := relay.Capabilities{relay.CapabilityResume}
+	s, addr, err := r.start(r.codec, caps, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if s.resumeToken == "" {
+		return errors.New("relay didn't give us a resume token")
+	}
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "before"); err != nil {
+		return err
+	}
+	if _, err := s.received(id, 6); err != nil {
+		return err
+	}
+	// Hang up without stopping. The client should stay connected and what it
+	// sends in the meantime should reach us once we're back.
+	if err := s.sendData(id, []byte("lost?")); err != nil {
+		return err
+	}
+	s.Close()
+	if _, err := io.WriteString(c, "during"); err != nil {
+		return fmt.Errorf("client was dropped: %w", err)
+	}
+	again, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer again.Close()
+	again.resumeToken, again.streamMsgs = s.resumeToken, s.streamMsgs
+	if err := again.hello(caps, 0); err != nil {
+		return err
+	}
+	msg, err := again.expect(relay.MessageTypeRelay)
+	if err != nil {
+		return err
+	}
+	if port(string(msg.Data)) != port(addr) {
+		return fmt.Errorf("resumed on %v instead of %v", msg.Data, addr)
+	}
+	// The data is the only stream message we sent.
+	switch msg.Ack {
+	case 0:
+		err = again.sendData(id, []byte("lost?"))
+	case 1:
+	default:
+		err = fmt.Errorf("relay acknowledged %v stream messages but we sent 1", msg.Ack)
+	}
+	if err != nil {
+		return err
+	}
+	if p, err := again.received(id, 6); err != nil {
+		return err
+	} else if string(p) != "during" {
+		return fmt.Errorf("relay sent %q instead of %q", p, "during")
+	}
+	if err := again.sendData(id, []byte("after")); err != nil {
+		return err
+	}
+	p := make([]byte, 10)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return fmt.Errorf("reading from the client: %w", err)
+	}
+	if string(p) != "lost?after" {
+		return fmt.Errorf("client got %q instead of %q", p, "lost?after")
+	}
+	return r.finish(again)
+}
+
+func (r *relayTest) resumeUnknown() error {
+	s, err := dialSession(r.addr, r.codec)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.resumeToken = "no-such-session"
+	if err := s.hello(relay.Capabilities{relay.CapabilityResume}, 0); err != nil {
+		return err
+	}
+	if !s.check.Capabilities().Has(relay.CapabilityResume) {
+		return errSkip
+	}
+	_, err = s.expect(relay.MessageTypeRelay)
+	var rerr *relay.Error
+	if !errors.As(err, &rerr) || rerr.Code != relay.ErrorCodeResume {
+		return fmt.Errorf("expected a resume error, got %v", err)
+	}
+	return s.expectEOF()
+}
+
+func (r *relayTest) listeners() error {
+	s, addr, err := r.start(r.codec, relay.Capabilities{relay.CapabilityListeners}, 0)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := s.send(&relay.Message{Type: relay.MessageTypeListen, Listener: 1}); err != nil {
+		return err
+	}
+	msg, err := s.expect(relay.MessageTypeRelay)
+	if err != nil {
+		return err
+	}
+	more, err := r.clientAddr(msg)
+	if err != nil {
+		return err
+	}
+	if port(more) == port(addr) {
+		return fmt.Errorf("both listeners got port %v", port(addr))
+	}
+	c, id, err := r.connectTo(s, more, 1)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		return err
+	}
+	if _, err := s.received(id, 5); err != nil {
+		return err
+	}
+	// The first port keeps working alongside it.
+	first, _, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	first.Close()
+	// Closing the listener leaves its clients alone.
+	if err := s.send(&relay.Message{Type: relay.MessageTypeUnlisten, Listener: 1}); err != nil {
+		return err
+	}
+	if err := s.sendData(id, []byte("still")); err != nil {
+		return err
+	}
+	p := make([]byte, 5)
+	if _, err := io.ReadFull(c, p); err != nil {
+		return fmt.Errorf("reading from the client: %w", err)
+	}
+	if conn, err := net.DialTimeout("tcp", more, timeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("%v still accepts clients", more)
+	}
+	// A port that can't be had only fails that listen.
+	want, _ := strconv.Atoi(port(addr))
+	if err := s.send(&relay.Message{Type: relay.MessageTypeListen, Listener: 2, Port: want}); err != nil {
+		return err
+	}
+	msg, err = s.expect(relay.MessageTypeError)
+	if err != nil {
+		return err
+	}
+	if msg.Listener != 2 || msg.Code != relay.ErrorCodePortInUse {
+		return fmt.Errorf("expected the %v error code for listener 2, got %v", relay.ErrorCodePortInUse, msg)
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) virtualHost() error {
+	caps := relay.Capabilities{relay.CapabilityRegister, relay.CapabilityVirtualHost}
+	host := fmt.Sprintf("conformance-%d.test", time.Now().UnixNano())
+	reg := &relay.Message{Type: relay.MessageTypeRegister, Host: host}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	// The relay reads the request to find us but we should still get all of
+	// it.
+	req := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	if _, err := io.WriteString(c, req); err != nil {
+		return err
+	}
+	msg, err := s.expect(relay.MessageTypeConnect)
+	if err != nil {
+		return err
+	}
+	p, err := s.received(msg.ID, len(req))
+	if err != nil {
+		return err
+	}
+	if string(p) != req {
+		return fmt.Errorf("relay sent %q instead of %q", p, req)
+	}
+	return r.finish(s)
+}
+
+func (r *relayTest) clientRules() error {
+	caps := relay.Capabilities{relay.CapabilityRegister, relay.CapabilityACL}
+	reg := &relay.Message{Type: relay.MessageTypeRegister, Deny: []string{"0.0.0.0/0", "::/0"}}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadAll(c); err != nil {
+		return fmt.Errorf("denied client wasn't closed: %w", err)
+	}
+	if err := r.finish(s); err != nil {
+		return err
+	}
+	if s.streamMsgs != 0 {
+		return errors.New("relay told us about a denied client")
+	}
+	return nil
+}
+
+func (r *relayTest) rateLimit() error {
+	caps := relay.Capabilities{relay.CapabilityRegister, relay.CapabilityRateLimit}
+	const rate = 4096
+	reg := &relay.Message{Type: relay.MessageTypeRegister, ClientRate: rate}
+	s, addr, err := r.register(r.codec, caps, 0, reg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	c, id, err := r.connect(s, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	// Past the first second's worth, the rest should take a second for each
+	// second's worth.
+	start := time.Now()
+	if _, err := c.Write(make([]byte, 3*rate)); err != nil {
+		return err
+	}
+	if _, err := s.received(id, 3*rate); err != nil {
+		return err
+	}
+	if took := time.Since(start); took < 1500*time.Millisecond {
+		return fmt.Errorf("relayed %v bytes in %v with a limit of %v a second", 3*rate, took, rate)
+	}
+	return r.finish(s)
+}
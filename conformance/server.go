@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// supported are the capabilities we agree to when playing the relay.
+var supported = relay.Capabilities{
+	relay.CapabilityFlowControl,
+	relay.CapabilityHalfClose,
+	relay.CapabilityKeepAlive,
+	relay.CapabilityRegister,
+	relay.CapabilityShutdown,
+}
+
+// testServer waits for a server to connect on addr and runs the scenarios
+// against it. We play the relay and the server should echo data back.
+func testServer(addr string) bool {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalln("listening:", err)
+	}
+	defer l.Close()
+	log.Println("waiting for a server on", l.Addr())
+	t := &serverTest{addr: l.Addr().String()}
+	s, err := acceptSession(l)
+	if err != nil {
+		log.Fatalln("accepting server:", err)
+	}
+	defer s.Close()
+	t.s = s
+	// The scenarios share the one connection so they have to run in order.
+	return runAll([]scenario{
+		{"handshake", t.handshake},
+		{"echo", t.echo},
+		{"multiple streams", t.streams},
+		{"large data", t.large},
+		{"close", t.close},
+		{"half close", t.halfClose},
+		{"keepalive", t.keepAlive},
+		{"unknown stream", t.unknownStream},
+		{"shutdown", t.shutdown},
+		{"error", t.relayError},
+	})
+}
+
+type serverTest struct {
+	addr   string
+	s      *session
+	ok     bool
+	lastID uint32
+}
+
+// connect pretends a client connected and returns its stream ID.
+func (t *serverTest) connect() (uint32, error) {
+	if !t.ok {
+		return 0, errors.New("handshake failed")
+	}
+	t.lastID++
+	return t.lastID, t.s.send(&relay.Message{
+		Type:       relay.MessageTypeConnect,
+		ID:         t.lastID,
+		RemoteAddr: fmt.Sprintf("192.0.2.1:%d", 1024+t.lastID),
+		LocalAddr:  t.addr,
+	})
+}
+
+// roundTrip sends p on the stream and checks the server sends it back.
+func (t *serverTest) roundTrip(id uint32, p []byte) error {
+	if err := t.s.sendData(id, p); err != nil {
+		return err
+	}
+	q, err := t.s.received(id, len(p))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(p, q) {
+		return fmt.Errorf("stream %v echoed different data", id)
+	}
+	return nil
+}
+
+func (t *serverTest) handshake() error {
+	if err := t.s.hello(supported, relay.DefaultWindow); err != nil {
+		return err
+	}
+	if t.s.check.Capabilities().Has(relay.CapabilityRegister) {
+		if _, err := t.s.expect(relay.MessageTypeRegister); err != nil {
+			return err
+		}
+	}
+	err := t.s.send(&relay.Message{Type: relay.MessageTypeRelay, Data: []byte(t.addr)})
+	if err != nil {
+		return err
+	}
+	t.ok = true
+	return nil
+}
+
+func (t *serverTest) echo() error {
+	id, err := t.connect()
+	if err != nil {
+		return err
+	}
+	return t.roundTrip(id, []byte("hello, world!"))
+}
+
+func (t *serverTest) streams() error {
+	a, err := t.connect()
+	if err != nil {
+		return err
+	}
+	b, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if err := t.s.sendData(a, []byte("first")); err != nil {
+		return err
+	}
+	if err := t.roundTrip(b, []byte("second")); err != nil {
+		return err
+	}
+	p, err := t.s.received(a, 5)
+	if err != nil {
+		return err
+	}
+	if string(p) != "first" {
+		return fmt.Errorf("stream %v echoed %q", a, p)
+	}
+	return nil
+}
+
+func (t *serverTest) large() error {
+	id, err := t.connect()
+	if err != nil {
+		return err
+	}
+	// Without flow control, we can't read while we write so stay small enough
+	// for the socket buffers.
+	n := 32 * 1024
+	if t.s.flow() {
+		n = 1024 * 1024
+	}
+	p := make([]byte, n)
+	rand.Read(p)
+	return t.roundTrip(id, p)
+}
+
+func (t *serverTest) close() error {
+	id, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if err := t.roundTrip(id, []byte("bye")); err != nil {
+		return err
+	}
+	if err := t.s.send(&relay.Message{Type: relay.MessageTypeClose, ID: id}); err != nil {
+		return err
+	}
+	// The server should carry on with other streams.
+	return t.echo()
+}
+
+func (t *serverTest) halfClose() error {
+	if !t.s.check.Capabilities().Has(relay.CapabilityHalfClose) {
+		return errSkip
+	}
+	id, err := t.connect()
+	if err != nil {
+		return err
+	}
+	if err := t.s.sendData(id, []byte("last")); err != nil {
+		return err
+	}
+	if err := t.s.send(&relay.Message{Type: relay.MessageTypeCloseWrite, ID: id}); err != nil {
+		return err
+	}
+	// An echo server has nothing more to say once the client is done.
+	done := func() bool { return t.s.writeClosed[id] || t.s.closed[id] }
+	if err := t.s.until("close write", done); err != nil {
+		return err
+	}
+	if p := t.s.data[id]; p == nil || p.String() != "last" {
+		return errors.New("server didn't echo everything before closing")
+	}
+	return t.s.send(&relay.Message{Type: relay.MessageTypeClose, ID: id})
+}
+
+func (t *serverTest) keepAlive() error {
+	if !t.s.check.Capabilities().Has(relay.CapabilityKeepAlive) {
+		return errSkip
+	}
+	return t.s.ping()
+}
+
+func (t *serverTest) unknownStream() error {
+	if !t.ok {
+		return errors.New("handshake failed")
+	}
+	// The server must ignore it. The checker fails us if it answers.
+	err := t.s.sendRaw(&relay.Message{Type: relay.MessageTypeData, ID: 1 << 31, Data: []byte("?")})
+	if err != nil {
+		return err
+	}
+	return t.echo()
+}
+
+func (t *serverTest) shutdown() error {
+	if !t.s.check.Capabilities().Has(relay.CapabilityShutdown) {
+		return errSkip
+	}
+	id, err := t.connect()
+	if err != nil {
+		return err
+	}
+	err = t.s.send(&relay.Message{
+		Type:      relay.MessageTypeShutdown,
+		Timestamp: time.Now().Add(time.Minute).Unix(),
+		Reason:    "conformance test",
+	})
+	if err != nil {
+		return err
+	}
+	// Streams the server already has should keep working.
+	return t.roundTrip(id, []byte("still here"))
+}
+
+func (t *serverTest) relayError() error {
+	if !t.ok {
+		return errors.New("handshake failed")
+	}
+	err := t.s.send(&relay.Message{
+		Type:   relay.MessageTypeError,
+		Code:   relay.ErrorCodeProtocol,
+		Reason: "conformance test",
+	})
+	if err != nil {
+		return err
+	}
+	return t.s.expectEOF()
+}
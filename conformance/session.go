@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// session is one control connection to the implementation being tested. Every
+// message in either direction goes through a relay.Checker so any protocol
+// violation fails the scenario that caused it.
+type session struct {
+	conn  net.Conn
+	enc   relay.Encoder
+	dec   relay.Decoder
+	check relay.Checker
+	// me is who we are playing and them is the implementation.
+	me, them relay.Direction
+	// grant tells recv whether it should hand the window back as soon as data
+	// arrives.
+	grant bool
+	// credit is how much more we may send on each stream when flow control
+	// is on.
+	credit map[uint32]int
+	// data is what we've received on each stream and closed and writeClosed
+	// what the implementation told us about each stream.
+	data        map[uint32]*bytes.Buffer
+	closed      map[uint32]bool
+	writeClosed map[uint32]bool
+	pongs       int
+	// peer is the hello the implementation sent.
+	peer *relay.Message
+	// resumeToken is the token the relay gave us, or the one we resume with,
+	// and streamMsgs how many stream messages we received.
+	resumeToken string
+	streamMsgs  uint64
+}
+
+func newSession(conn net.Conn, me relay.Direction, enc relay.Encoder, dec relay.Decoder) *session {
+	them := relay.FromServer
+	if me == relay.FromServer {
+		them = relay.FromRelay
+	}
+	return &session{
+		conn:        conn,
+		enc:         enc,
+		dec:         dec,
+		me:          me,
+		them:        them,
+		grant:       true,
+		credit:      make(map[uint32]int),
+		data:        make(map[uint32]*bytes.Buffer),
+		closed:      make(map[uint32]bool),
+		writeClosed: make(map[uint32]bool),
+	}
+}
+
+// dialSession connects to a relay as a server and sends our codec.
+func dialSession(addr string, codec relay.Codec) (*session, error) {
+	var conn net.Conn
+	var err error
+	if useTLS {
+		d := &net.Dialer{Timeout: timeout}
+		conn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := relay.WriteCodec(conn, codec); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newSession(conn, relay.FromServer, codec.NewEncoder(conn), codec.NewDecoder(conn)), nil
+}
+
+// acceptSession waits for a server to connect to us and reads its codec.
+func acceptSession(l net.Listener) (*session, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	r := bufio.NewReader(conn)
+	codec, err := relay.ReadCodec(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading codec: %w", err)
+	}
+	return newSession(conn, relay.FromRelay, codec.NewEncoder(conn), codec.NewDecoder(r)), nil
+}
+
+func (s *session) Close() error {
+	return s.conn.Close()
+}
+
+// send checks msg against the spec and sends it.
+func (s *session) send(msg *relay.Message) error {
+	if err := s.check.Check(msg, s.me); err != nil {
+		return fmt.Errorf("bug in conformance: we sent %v: %w", msg, err)
+	}
+	if msg.Type == relay.MessageTypeConnect {
+		s.credit[msg.ID] = int(s.peer.Window)
+	}
+	return s.sendRaw(msg)
+}
+
+// sendRaw sends msg without checking it. It's used to break the protocol on
+// purpose.
+func (s *session) sendRaw(msg *relay.Message) error {
+	s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := s.enc.Encode(msg); err != nil {
+		return fmt.Errorf("sending %v: %w", msg.Type, err)
+	}
+	return nil
+}
+
+// flow returns true if flow control was agreed to.
+func (s *session) flow() bool {
+	return s.check.Capabilities().Has(relay.CapabilityFlowControl)
+}
+
+// recv gets the next message from the implementation and checks it. Stream
+// messages are recorded so the scenarios can wait for what they expect.
+func (s *session) recv() (*relay.Message, error) {
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	msg := &relay.Message{}
+	if err := s.dec.Decode(msg); err != nil {
+		return nil, err
+	}
+	if err := s.check.Check(msg, s.them); err != nil {
+		return nil, fmt.Errorf("%v sent %v: %w", s.them, msg, err)
+	}
+	if msg.ID != 0 {
+		s.streamMsgs++
+	}
+	switch msg.Type {
+	case relay.MessageTypeRelay:
+		s.resumeToken = msg.ResumeToken
+	case relay.MessageTypeConnect:
+		s.credit[msg.ID] = int(s.peer.Window)
+	case relay.MessageTypeData:
+		b := s.data[msg.ID]
+		if b == nil {
+			b = &bytes.Buffer{}
+			s.data[msg.ID] = b
+		}
+		b.Write(msg.Data)
+		if s.grant && s.flow() {
+			err := s.send(&relay.Message{Type: relay.MessageTypeWindow, ID: msg.ID, Window: uint32(len(msg.Data))})
+			if err != nil {
+				return nil, err
+			}
+		}
+	case relay.MessageTypeWindow:
+		s.credit[msg.ID] += int(msg.Window)
+	case relay.MessageTypeCloseWrite:
+		s.writeClosed[msg.ID] = true
+	case relay.MessageTypeClose:
+		s.closed[msg.ID] = true
+	case relay.MessageTypePing:
+		if err := s.send(&relay.Message{Type: relay.MessageTypePong}); err != nil {
+			return nil, err
+		}
+	case relay.MessageTypePong:
+		s.pongs++
+	}
+	return msg, nil
+}
+
+// until receives messages until done returns true.
+func (s *session) until(what string, done func() bool) error {
+	for !done() {
+		if _, err := s.recv(); err != nil {
+			return fmt.Errorf("waiting for %v: %w", what, err)
+		}
+	}
+	return nil
+}
+
+// expect returns the next message that isn't about streams or keepalives and
+// fails if it isn't of type t.
+func (s *session) expect(t relay.MessageType) (*relay.Message, error) {
+	for {
+		msg, err := s.recv()
+		if err != nil {
+			return nil, fmt.Errorf("waiting for %v: %w", t, err)
+		}
+		switch msg.Type {
+		case t:
+			return msg, nil
+		case relay.MessageTypeData, relay.MessageTypeWindow, relay.MessageTypeClose,
+			relay.MessageTypeCloseWrite, relay.MessageTypePing, relay.MessageTypePong,
+			relay.MessageTypeAck:
+			continue
+		case relay.MessageTypeError:
+			return nil, fmt.Errorf("expected %v, got %w", t, &relay.Error{Code: msg.Code, Reason: msg.Reason})
+		}
+		return nil, fmt.Errorf("expected %v, got %v", t, msg)
+	}
+}
+
+// expectEOF waits for the implementation to close the connection.
+func (s *session) expectEOF() error {
+	for {
+		_, err := s.recv()
+		var ne net.Error
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, relay.ErrSpec):
+			return err
+		case errors.As(err, &ne) && ne.Timeout():
+			return errors.New("connection wasn't closed")
+		}
+		return nil
+	}
+}
+
+// hello sends or answers a hello. As a server we offer caps and as a relay we
+// agree to the ones in caps the server offered. A server resumes the session
+// of resumeToken if it's set.
+func (s *session) hello(caps relay.Capabilities, window uint32) error {
+	msg := &relay.Message{
+		Type:         relay.MessageTypeHello,
+		Version:      relay.ProtocolVersion,
+		Capabilities: caps,
+		Window:       window,
+	}
+	if s.me == relay.FromServer {
+		msg.Token = token
+		if s.resumeToken != "" {
+			msg.ResumeToken, msg.Ack = s.resumeToken, s.streamMsgs
+		}
+		if err := s.send(msg); err != nil {
+			return err
+		}
+		reply, err := s.expect(relay.MessageTypeHello)
+		if err != nil {
+			return err
+		}
+		if reply.Version != relay.ProtocolVersion {
+			return fmt.Errorf("relay speaks version %v", reply.Version)
+		}
+		s.peer = reply
+		return nil
+	}
+	offer, err := s.expect(relay.MessageTypeHello)
+	if err != nil {
+		return err
+	}
+	if offer.Version != relay.ProtocolVersion {
+		return fmt.Errorf("server speaks version %v", offer.Version)
+	}
+	s.peer = offer
+	msg.Capabilities = caps.Negotiate(offer.Capabilities)
+	if !msg.Capabilities.Has(relay.CapabilityFlowControl) {
+		msg.Window = 0
+	}
+	return s.send(msg)
+}
+
+// sendData sends p on the given stream, waiting for window updates when flow
+// control is on.
+func (s *session) sendData(id uint32, p []byte) error {
+	for len(p) > 0 {
+		n := min(len(p), relay.MaxDataSize)
+		if s.flow() {
+			if err := s.until("window update", func() bool { return s.credit[id] > 0 }); err != nil {
+				return err
+			}
+			n = min(n, s.credit[id])
+			s.credit[id] -= n
+		}
+		err := s.send(&relay.Message{Type: relay.MessageTypeData, ID: id, Data: p[:n]})
+		if err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// received waits until n bytes have been received on the given stream and
+// returns them.
+func (s *session) received(id uint32, n int) ([]byte, error) {
+	err := s.until(fmt.Sprintf("%v bytes on stream %v", n, id), func() bool {
+		b := s.data[id]
+		return b != nil && b.Len() >= n
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.data[id].Next(n), nil
+}
+
+// ping sends a ping and waits for the pong.
+func (s *session) ping() error {
+	want := s.pongs + 1
+	if err := s.send(&relay.Message{Type: relay.MessageTypePing}); err != nil {
+		return err
+	}
+	return s.until("pong", func() bool { return s.pongs >= want })
+}
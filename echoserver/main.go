@@ -13,6 +13,9 @@ import (
 var (
 	relayAddr string
 	reverse   bool
+	port      int
+	service   string
+	token     string
 )
 
 func init() {
@@ -20,6 +23,12 @@ func init() {
 		"the addr:port of the relay server.")
 	flag.BoolVar(&reverse, "reverse", false,
 		"send the string back in reverse.")
+	flag.IntVar(&port, "port", 0,
+		"the relay port to ask for. Zero lets the relay pick.")
+	flag.StringVar(&service, "service", "",
+		"the service name to register with so the port stays the same across restarts.")
+	flag.StringVar(&token, "token", "",
+		"the token to authenticate with if the relay requires one.")
 }
 
 func main() {
@@ -31,35 +40,80 @@ func main() {
 		log.Fatalln("connecting to relay:", err)
 	}
 
-	// Setup a json encoder/decoder.
+	// Tell the relay we speak JSON and setup a json encoder/decoder.
+	if err := relay.WriteCodec(conn, relay.JSONCodec); err != nil {
+		log.Fatalln("sending codec:", err)
+	}
 	dec := json.NewDecoder(conn)
 	enc := json.NewEncoder(conn)
 
-	// The first message should be our relay message.
-	msg := &relay.Message{}
+	// Say hello. The only optional feature we support is registering for a
+	// port and we only need it if we were asked for one.
+	register := port != 0 || service != ""
+	msg := &relay.Message{Type: relay.MessageTypeHello, Version: relay.ProtocolVersion, Token: token}
+	if register {
+		msg.Capabilities = relay.Capabilities{relay.CapabilityRegister}
+	}
+	if err := enc.Encode(msg); err != nil {
+		log.Fatalln("sending hello:", err)
+	}
 	err = dec.Decode(msg)
+	if msg.Type == relay.MessageTypeError {
+		log.Fatalf("relay refused us (%v): %v", msg.Code, msg.Reason)
+	}
+	if msg.Type != relay.MessageTypeHello || msg.Version != relay.ProtocolVersion {
+		log.Fatalln("unexpected hello:", msg)
+	}
+	if register {
+		if !msg.Capabilities.Has(relay.CapabilityRegister) {
+			log.Fatalln("relay can't give us a port")
+		}
+		msg = &relay.Message{Type: relay.MessageTypeRegister, Port: port, Service: service}
+		if err := enc.Encode(msg); err != nil {
+			log.Fatalln("registering:", err)
+		}
+	}
+
+	// The next message should be our relay message unless the relay refused us.
+	err = dec.Decode(msg)
+	if msg.Type == relay.MessageTypeError {
+		log.Fatalf("relay refused us (%v): %v", msg.Code, msg.Reason)
+	}
 	if msg.Type != relay.MessageTypeRelay {
 		log.Fatalln("unexpected message:", msg)
 	}
 	log.Println("client connection:", string(msg.Data))
 
 	// For the rest of the time, we simply read a message and write it back if it's
-	// a Data message.
+	// a Data message for a stream we know about.
+	streams := make(map[uint32]bool)
 	for {
 		err = dec.Decode(msg)
 		if err != nil {
 			log.Fatalln("getting message:", err)
 		}
-		if msg.Type != relay.MessageTypeData {
-			// Ignore everything else. If we were interested in maintaining state, we'd
-			// want to use a map of some sort to track new connections and close open
-			// ones.
+		switch msg.Type {
+		case relay.MessageTypeConnect:
+			streams[msg.ID] = true
+			continue
+		case relay.MessageTypeClose:
+			delete(streams, msg.ID)
+			continue
+		case relay.MessageTypeError:
+			log.Fatalf("relay gave up on us (%v): %v", msg.Code, msg.Reason)
+		case relay.MessageTypeData:
+		default:
+			// Ignore everything else.
+			continue
+		}
+		if !streams[msg.ID] {
 			continue
 		}
+		reply := &relay.Message{Type: relay.MessageTypeData, ID: msg.ID, Data: msg.Data}
 		if reverse {
-			msg.Data = Reverse(msg.Data)
+			reply.Data = Reverse(reply.Data)
 		}
-		err = enc.Encode(msg)
+		err = enc.Encode(reply)
 		if err != nil {
 			log.Fatalln("sending message:", err)
 		}
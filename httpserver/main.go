@@ -1,21 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/icub3d/tcprelay/relay"
 )
 
-// TODO we should probably handle shutdowns properly, right now the world just
-// stops abruptly. Use a signalhandler to catch the signal, close the listener
-// so we don't accept anymore, close all the clients, and send the stop to the
-// relay.
-
 var (
 	relayAddr string
 	dir       string
+	timeout   time.Duration
+	port      int
+	service   string
+	host      string
+	token     string
+	identity  string
+	secret    string
+
+	https   bool
+	useTLS  bool
+	tlsCA   string
+	tlsPin  string
+	tlsCert string
+	tlsKey  string
 )
 
 func init() {
@@ -23,19 +42,173 @@ func init() {
 		"the addr:port of the relay server.")
 	flag.StringVar(&dir, "dir", ".",
 		"the directory to serve.")
+	flag.DurationVar(&timeout, "timeout", time.Minute,
+		"how long to wait for slow or idle clients.")
+	flag.IntVar(&port, "port", 0,
+		"the relay port to ask for. Zero lets the relay pick.")
+	flag.StringVar(&service, "service", "",
+		"the service name to register with so the port stays the same across restarts.")
+	flag.StringVar(&host, "host", "",
+		"the hostname to serve on the relay's shared port instead of a port of our own.")
+	flag.StringVar(&token, "token", "",
+		"the token to authenticate with if the relay requires one.")
+	flag.StringVar(&identity, "identity", "",
+		"the identity to sign our hello as instead of sending a token.")
+	flag.StringVar(&secret, "secret", "",
+		"the secret to sign our hello with.")
+	flag.BoolVar(&https, "https", false,
+		"have the relay serve HTTPS to clients with its certificate for us.")
+	flag.BoolVar(&useTLS, "tls", false,
+		"talk to the relay over TLS.")
+	flag.StringVar(&tlsCA, "tls-ca", "",
+		"the CA certificate file to verify the relay with instead of the system roots.")
+	flag.StringVar(&tlsPin, "tls-pin", "",
+		"the base64 pin of the relay's certificate. If given, it's all we trust.")
+	flag.StringVar(&tlsCert, "tls-cert", "",
+		"the client certificate file to authenticate with.")
+	flag.StringVar(&tlsKey, "tls-key", "",
+		"the key file for -tls-cert.")
+}
+
+// stoppable lets http.Server.Shutdown stop taking clients while the ones it has
+// finish. Closing the relay.Listener would cut them off, so that's left until
+// they're done.
+type stoppable struct {
+	l     *relay.Listener
+	conns chan net.Conn
+	// err is why the relay.Listener stopped. It's set before conns is
+	// closed.
+	err  error
+	stop chan struct{}
+	once sync.Once
+}
+
+func newStoppable(l *relay.Listener) *stoppable {
+	s := &stoppable{l: l, conns: make(chan net.Conn), stop: make(chan struct{})}
+	go s.accept()
+	return s
+}
+
+// accept hands the clients of the relay.Listener to Accept until it's closed.
+// Those that come in after we stopped are turned away.
+func (s *stoppable) accept() {
+	defer close(s.conns)
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			s.err = err
+			return
+		}
+		select {
+		case s.conns <- conn:
+		case <-s.stop:
+			conn.Close()
+		}
+	}
+}
+
+func (s *stoppable) Accept() (net.Conn, error) {
+	select {
+	case conn, ok := <-s.conns:
+		if !ok {
+			return nil, s.err
+		}
+		return conn, nil
+	case <-s.stop:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *stoppable) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+func (s *stoppable) Addr() net.Addr {
+	return s.l.Addr()
 }
 
 func main() {
 	flag.Parse()
 
-	l, client, err := relay.Dial(relayAddr)
+	d := &relay.Dialer{
+		Port:     port,
+		Service:  service,
+		Host:     host,
+		Token:    token,
+		Identity: identity,
+		Secret:   []byte(secret),
+	}
+	if https {
+		// We only get plaintext so we can't speak HTTP/2.
+		d.TerminateTLS = true
+		d.Protocols = []string{"http/1.1"}
+	}
+	if useTLS || tlsCA != "" || tlsCert != "" {
+		d.TLSConfig = &tls.Config{}
+		if tlsCA != "" {
+			pem, err := os.ReadFile(tlsCA)
+			if err != nil {
+				log.Fatalln("reading CA:", err)
+			}
+			d.TLSConfig.RootCAs = x509.NewCertPool()
+			d.TLSConfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+		if tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+			if err != nil {
+				log.Fatalln("loading certificate:", err)
+			}
+			d.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	if tlsPin != "" {
+		pin, err := base64.StdEncoding.DecodeString(tlsPin)
+		if err != nil {
+			log.Fatalln("decoding pin:", err)
+		}
+		d.Pins = [][]byte{pin}
+		// The pin replaces the usual verification.
+		if d.TLSConfig != nil && tlsCA == "" {
+			d.TLSConfig.InsecureSkipVerify = true
+		}
+	}
+	l, client, err := d.Dial(relayAddr)
 	if err != nil {
 		log.Fatalln("connecting to relay relay:", err)
 	}
 	log.Println("client connection:", client)
 
 	s := &http.Server{
-		Handler: http.FileServer(http.Dir(dir)),
+		Handler:     http.FileServer(http.Dir(dir)),
+		ReadTimeout: timeout,
+		IdleTimeout: timeout,
+	}
+	// Let clients finish what they're doing when the relay shuts down but
+	// don't keep their connections around.
+	go func() {
+		<-l.Draining()
+		s.SetKeepAlivesEnabled(false)
+	}()
+	// On a signal, finish the requests in flight and then tell the relay
+	// we're done.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		<-signals
+		log.Println("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Println("shutting down:", err)
+		}
+		l.Close()
+		close(done)
+	}()
+	if err := s.Serve(newStoppable(l)); err != http.ErrServerClosed {
+		log.Println(err)
+		return
 	}
-	log.Println(s.Serve(l))
+	<-done
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// publicListener is a port clients connect to for a server. Every server has
+// the one it registered for, with the ID zero, and may open more with
+// relay.CapabilityListeners. A listener for a host gets its clients from the
+// shared port and one for a service from the service's pool. Neither has a
+// port of its own.
+type publicListener struct {
+	id       uint32
+	port     int
+	host     string
+	addr     string
+	service  string
+	listener net.Listener
+	// tlsConfig is used to terminate TLS for clients if the server asked us
+	// to.
+	tlsConfig *tls.Config
+	// acl are the rules the server gave for who may connect.
+	acl *acl
+}
+
+// close stops listening for clients and releases the port so it can be handed
+// out again.
+func (p *publicListener) close() {
+	p.listener.Close()
+	if p.port != 0 {
+		releasePort(p.port)
+	}
+}
+
+// publicPort returns the port clients connect to or zero if it's the shared
+// port.
+func (p *publicListener) publicPort() int {
+	if m, ok := p.listener.(*poolMember); ok {
+		return m.pool.port
+	}
+	return p.port
+}
+
+// openListener claims the port or host msg, a register or listen message,
+// asks for and listens on it. Servers registering the same service share its
+// port. TLS is set up if msg wants it. A *relay.Error is returned when the
+// server should be refused.
+func (s *server) openListener(id uint32, msg *relay.Message) (*publicListener, error) {
+	p := &publicListener{id: id, host: msg.Host, service: msg.Service}
+	var err error
+	if p.acl, err = parseACL(msg.Allow, msg.Deny); err != nil {
+		return nil, &relay.Error{Code: relay.ErrorCodeProtocol, Reason: err.Error()}
+	}
+	if msg.TLS {
+		cfg, err := publicTLSConfig(p.host, p.service, s.identity)
+		if err != nil {
+			return nil, &relay.Error{Code: relay.ErrorCodeTLS, Reason: err.Error()}
+		}
+		cfg.NextProtos = msg.Protocols
+		p.tlsConfig = cfg
+	}
+	if p.host != "" {
+		if err := s.openHost(p, msg); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if p.service != "" {
+		m, err := joinPool(p.service, s.identity, msg.Port, msg.Fallback)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			p.listener, p.addr = m, m.pool.addr
+			return p, nil
+		}
+	}
+	want, fallback := msg.Port, msg.Fallback
+	// A service's port from the config is the only one it gets. Its old port
+	// is only a preference.
+	if want == 0 && p.service != "" {
+		if sc := serviceSettings(p.service); sc.Port != 0 {
+			want, fallback = sc.Port, false
+		} else {
+			want, fallback = servicePort(p.service), true
+		}
+	}
+	if want != 0 {
+		err := claimPort(want)
+		if err == nil {
+			p.port = want
+		} else if !fallback {
+			code := relay.ErrorCodePortInUse
+			if err == ErrPortNotAllowed {
+				code = relay.ErrorCodePortNotAllowed
+			}
+			return nil, &relay.Error{Code: code, Reason: fmt.Sprintf("port %v: %v", want, err)}
+		}
+	}
+	if p.port == 0 {
+		p.port = findUnusedPort()
+		if p.port == -1 {
+			return nil, &relay.Error{Code: relay.ErrorCodeNoPorts, Reason: "no ports available"}
+		}
+	}
+	addr, _, _ := portRange()
+	p.addr = fmt.Sprintf("%v:%v", addr, p.port)
+	p.listener, err = net.Listen("tcp", p.addr)
+	if err != nil {
+		s.log.Error("unable to listen", "addr", p.addr, "err", err)
+		releasePort(p.port)
+		return nil, &relay.Error{Code: relay.ErrorCodeBind, Reason: fmt.Sprintf("unable to listen on %v", p.addr)}
+	}
+	if p.service != "" {
+		m := newPool(p.service, s.identity, p.port, p.addr, p.listener)
+		if m == nil {
+			// Another server of the service got there first so we try to
+			// join it instead.
+			p.listener.Close()
+			releasePort(p.port)
+			return s.openListener(id, msg)
+		}
+		rememberService(p.service, p.port)
+		// The pool releases the port once every server of the service is
+		// gone.
+		p.listener, p.port = m, 0
+	}
+	return p, nil
+}
+
+// openHost claims p's host on the shared port.
+func (s *server) openHost(p *publicListener, msg *relay.Message) error {
+	if sharedListener == nil {
+		return &relay.Error{Code: relay.ErrorCodeProtocol, Reason: "no shared port"}
+	}
+	if msg.Port != 0 {
+		return &relay.Error{Code: relay.ErrorCodeProtocol, Reason: "a host doesn't get a port"}
+	}
+	l, err := claimHost(p.host)
+	if err != nil {
+		return &relay.Error{Code: relay.ErrorCodeHostInUse, Reason: fmt.Sprintf("host %v: %v", p.host, err)}
+	}
+	p.listener, p.addr = l, sharedAddr
+	return nil
+}
+
+// addListener adds p to the server's listeners. The caller has to start
+// listen for it once the server knows about it. It fails if the server is
+// closed or draining.
+func (s *server) addListener(p *publicListener) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.draining || isClosed(s.close) {
+		return &relay.Error{Code: relay.ErrorCodeShutdown, Reason: "relay is shutting down"}
+	}
+	s.listeners[p.id] = p
+	s.wg.Add(1)
+	return nil
+}
+
+// publicListeners returns the listeners the server has open.
+func (s *server) publicListeners() []*publicListener {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	all := make([]*publicListener, 0, len(s.listeners))
+	for _, p := range s.listeners {
+		all = append(all, p)
+	}
+	return all
+}
+
+// listenMore opens another public listener for the server as msg asks and
+// tells the server how it went.
+func (s *server) listenMore(msg *relay.Message) {
+	s.lock.Lock()
+	reused := msg.Listener <= s.lastListener
+	s.lastListener = max(s.lastListener, msg.Listener)
+	s.lock.Unlock()
+	var p *publicListener
+	var err error
+	if reused {
+		err = &relay.Error{Code: relay.ErrorCodeProtocol, Reason: fmt.Sprintf("listener %v reused or out of order", msg.Listener)}
+	} else if p, err = s.openListener(msg.Listener, msg); err == nil {
+		if err = s.addListener(p); err != nil {
+			p.close()
+		}
+	}
+	if err != nil {
+		var rerr *relay.Error
+		if !errors.As(err, &rerr) {
+			rerr = &relay.Error{Code: relay.ErrorCodeBind, Reason: err.Error()}
+		}
+		s.log.Warn("refusing listener", "listener", msg.Listener, "code", rerr.Code, "reason", rerr.Reason)
+		s.Send(&relay.Message{
+			Type:     relay.MessageTypeError,
+			Code:     rerr.Code,
+			Reason:   rerr.Reason,
+			Listener: msg.Listener,
+		})
+		return
+	}
+	log := s.log.With("listener", p.id, "addr", p.addr)
+	if p.host != "" {
+		log.Info("host registered", "host", p.host)
+	} else if p.service != "" {
+		log.Info("service registered", "service", p.service)
+	} else {
+		log.Info("listening")
+	}
+	// Clients may only show up once the server knows about the listener.
+	s.Send(&relay.Message{
+		Type:     relay.MessageTypeRelay,
+		Data:     []byte(p.addr),
+		Listener: p.id,
+	})
+	go s.listen(p)
+}
+
+// unlisten closes the public listener with the given ID. Its clients stay
+// connected.
+func (s *server) unlisten(id uint32) {
+	s.lock.Lock()
+	p := s.listeners[id]
+	// The one the server registered for lasts as long as the server.
+	if id != 0 {
+		delete(s.listeners, id)
+	}
+	s.lock.Unlock()
+	if p == nil || id == 0 {
+		s.log.Warn("unable to unlisten - no listener", "listener", id)
+		return
+	}
+	p.close()
+	s.log.Info("closed listener", "listener", id, "addr", p.addr)
+}
@@ -2,61 +2,286 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
 )
 
 var (
-	// These are the command-line arguments.
-	addr      string
-	ports     string
-	saddr     string
-	low, high int
+	// These are the command-line arguments. saddr, low and high are guarded
+	// by upLock as they change when the config is reloaded.
+	addr       string
+	ports      string
+	saddr      string
+	low, high  int
+	window     uint32
+	configFile string
+
+	keepAlive        time.Duration
+	keepAliveTimeout time.Duration
+	compress         bool
+	tokenFile        string
+	certFile         string
+	keyFile          string
+	clientCA         string
+	publicCertFile   string
+	publicKeyFile    string
+	publicCertDir    string
+	resumeGrace      time.Duration
+	resumeBuffer     int
+	drainTimeout     time.Duration
+	sharedAddr       string
+	adminAddr        string
+	metricsAddr      string
+	logFormat        string
+	logLevel         slog.LevelVar
+	allow            string
+	deny             string
+	controlAllow     string
+	controlDeny      string
+
+	// sharedListener is the public port shared by servers that register a
+	// host. It's nil unless -shared-addr was given.
+	sharedListener net.Listener
 
-	// the ports currently in use by servers.
+	// tokens are the credentials servers must present. If nil, servers don't
+	// need to authenticate.
+	tokens atomic.Pointer[tokenStore]
+
+	// the ports currently in use by servers and the port each named service
+	// last registered with.
 	usedPorts = map[int]bool{}
+	services  = map[string]int{}
 	upLock    = sync.Mutex{}
 
 	// ErrInvalidPortRange is returned when parsing the ports command-line
 	// argument fails.
 	ErrInvalidPortRange = errors.New("invalid port range")
+
+	// ErrPortInUse and ErrPortNotAllowed are returned by claimPort when the
+	// port can't be used.
+	ErrPortInUse      = errors.New("port in use")
+	ErrPortNotAllowed = errors.New("port outside of the port range")
 )
 
 func init() {
 	flag.StringVar(&addr, "addr", ":8000",
 		"the addr:port upon which servers communicate with this relay.")
+	flag.StringVar(&configFile, "config", "",
+		"a JSON file of settings keyed by flag name plus identities and services. Flags given on the command line win. It's reread on SIGHUP.")
 	flag.StringVar(&ports, "ports", ":8001-9000",
 		"the addr and port range (inclusive) wherein servers will be assigned relay ports.")
+	flag.Func("window", "the number of bytes buffered per client. Servers that don't do flow control wait for clients that fall further behind.",
+		parseWindow)
+	window = relay.DefaultWindow
+	flag.DurationVar(&keepAlive, "keepalive", relay.DefaultKeepAlive,
+		"how often servers are pinged. Zero disables pings.")
+	flag.DurationVar(&keepAliveTimeout, "keepalive-timeout", 3*relay.DefaultKeepAlive,
+		"how long to wait to hear from a server before giving up on it.")
+	flag.BoolVar(&compress, "compress", true,
+		"compress data sent to servers that support it.")
+	flag.StringVar(&tokenFile, "tokens", "",
+		"a file of \"identity secret\" lines. If given, servers must authenticate with one of them.")
+	flag.StringVar(&certFile, "cert", "",
+		"the certificate file to use for TLS on -addr. Requires -key.")
+	flag.StringVar(&keyFile, "key", "",
+		"the key file for -cert.")
+	flag.StringVar(&clientCA, "client-ca", "",
+		"a CA certificate file. If given, servers must present a certificate signed by it.")
+	flag.StringVar(&publicCertFile, "public-cert", "",
+		"the certificate file (e.g. a wildcard) used to terminate TLS for servers that ask for it.")
+	flag.StringVar(&publicKeyFile, "public-key", "",
+		"the key file for -public-cert.")
+	flag.StringVar(&publicCertDir, "public-cert-dir", "",
+		"a directory of NAME.pem and NAME.key files used to terminate TLS for the server with that service name or identity.")
+	flag.DurationVar(&resumeGrace, "resume-grace", 30*time.Second,
+		"how long a server that lost its connection has to resume before its clients are dropped. Zero disables resuming.")
+	flag.IntVar(&resumeBuffer, "resume-buffer", 1024*1024,
+		"the number of bytes buffered for a server while it's resuming before its clients have to wait.")
+	flag.DurationVar(&drainTimeout, "drain", 30*time.Second,
+		"how long to let clients finish when shutting down on SIGTERM or SIGINT.")
+	flag.StringVar(&sharedAddr, "shared-addr", "",
+		"the addr:port of a public port shared by servers that register a hostname. Clients are sent to them by TLS SNI or HTTP Host header.")
+	flag.StringVar(&adminAddr, "admin-addr", "",
+		"the addr:port of an HTTP API for inspecting and managing servers and clients. It has no authentication, so keep it private.")
+	flag.StringVar(&metricsAddr, "metrics-addr", "",
+		"the addr:port to serve only /metrics on in the Prometheus text format. It's also part of the admin API.")
+	flag.StringVar(&logFormat, "log-format", "text",
+		"how log lines are written: text or json.")
+	flag.TextVar(&logLevel, "log-level", new(slog.LevelVar),
+		"the least important log lines written: debug, info, warn or error.")
+	flag.StringVar(&allow, "allow", "",
+		"comma separated CIDR prefixes or addresses clients have to come from to connect to public ports.")
+	flag.StringVar(&deny, "deny", "",
+		"comma separated CIDR prefixes or addresses clients can't connect to public ports from.")
+	flag.StringVar(&controlAllow, "control-allow", "",
+		"comma separated CIDR prefixes or addresses servers have to come from to connect.")
+	flag.StringVar(&controlDeny, "control-deny", "",
+		"comma separated CIDR prefixes or addresses servers can't connect from.")
+	flag.Var(&setting{value: "0", set: parseTotalRate}, "rate",
+		"the most bytes per second relayed each way for everyone together, e.g. 10m. Zero means no limit.")
+	flag.Var(&setting{value: "0", set: parseServerRate}, "server-rate",
+		"the most bytes per second relayed each way for all of a server's clients together. Zero means no limit.")
+	flag.Var(&setting{value: "0", set: parseClientRate}, "client-rate",
+		"the most bytes per second relayed each way for each client. Zero means no limit.")
+	flag.Var(&setting{value: balanceRoundRobin, set: parseBalance}, "balance",
+		"how clients are spread across the servers registered under one service: round-robin, least-conn or random.")
 }
 
 func main() {
 	// Parse the args and make sure the range is valid.
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+	rememberBase()
+	cfg := &config{}
+	if configFile != "" {
+		var err error
+		if cfg, err = applyConfig(configFile); err != nil {
+			fatal("loading config", "err", err)
+		}
+	}
+	if err := setupLogging(logFormat, &logLevel); err != nil {
+		fatal("setting up logging", "err", err)
+	}
 	var err error
 	saddr, low, high, err = parsePorts(ports)
 	if err != nil {
-		log.Fatalf("invalid port range: %v", ports)
+		fatal("invalid port range", "ports", ports)
+	}
+	slog.Info("starting", "addr", addr, "ports", fmt.Sprintf("%v:%v-%v", saddr, low, high))
+	t, err := buildTokens(tokenFile, cfg.identities)
+	if err != nil {
+		fatal("loading tokens", "err", err)
+	}
+	if t != nil {
+		tokens.Store(t)
+		slog.Info("servers must authenticate", "identities", len(t.secrets))
+	}
+
+	public, err := parseACLFlags(allow, deny)
+	if err != nil {
+		fatal("invalid client rules", "err", err)
+	}
+	publicACL.Store(public)
+	control, err := parseACLFlags(controlAllow, controlDeny)
+	if err != nil {
+		fatal("invalid server rules", "err", err)
+	}
+	controlACL.Store(control)
+
+	if publicCertFile != "" || publicKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(publicCertFile, publicKeyFile)
+		if err != nil {
+			fatal("loading public certificate", "err", err)
+		}
+		publicCert = &cert
+	}
+	if publicCert != nil || publicCertDir != "" {
+		capabilities = append(capabilities, relay.CapabilityTLS)
+	}
+	if resumeGrace > 0 {
+		capabilities = append(capabilities, relay.CapabilityResume)
+	}
+	if sharedAddr != "" {
+		sharedListener, err = net.Listen("tcp", sharedAddr)
+		if err != nil {
+			fatal("unable to listen on the shared port", "err", err)
+		}
+		slog.Info("listening on the shared port", "addr", sharedAddr)
+		capabilities = append(capabilities, relay.CapabilityVirtualHost)
+		go serveShared(sharedListener)
+	}
+
+	if adminAddr != "" {
+		l, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			fatal("unable to listen for the admin API", "err", err)
+		}
+		slog.Info("serving the admin API", "addr", adminAddr)
+		go serveAdmin(l)
+	}
+	if metricsAddr != "" {
+		l, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			fatal("unable to listen for metrics", "err", err)
+		}
+		slog.Info("serving metrics", "addr", metricsAddr)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+		go http.Serve(l, mux)
 	}
-	log.Printf("addr: %v, port range: %v:%v-%v", addr, saddr, low, high)
 
 	// Start listening for new servers.
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("unable to start server: %v", err)
+		fatal("unable to start server", "err", err)
 	}
+	if certFile != "" || keyFile != "" {
+		cfg, err := controlTLSConfig(certFile, keyFile, clientCA)
+		if err != nil {
+			fatal("loading TLS config", "err", err)
+		}
+		listener = tls.NewListener(listener, cfg)
+	} else if clientCA != "" {
+		fatal("-client-ca requires -cert and -key")
+	}
+	// Stop taking new servers on the first signal and drain the ones we
+	// have. Don't wait on a second one.
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		slog.Info("shutting down", "signal", (<-signals).String())
+		listener.Close()
+		if sharedListener != nil {
+			sharedListener.Close()
+		}
+		fatal("exiting now", "signal", (<-signals).String())
+	}()
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		for range hups {
+			if err := reloadConfig(configFile); err != nil {
+				slog.Error("config not reloaded", "err", err)
+				continue
+			}
+			slog.Info("config reloaded")
+		}
+	}()
 	for {
-		// TODO - should probably exit cleanly.
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
 		if err != nil {
-			log.Printf("error during Accept(): %v", err)
+			slog.Error("accepting servers", "err", err)
+			continue
+		}
+		if !controlACL.Load().permits(conn.RemoteAddr()) {
+			slog.Info("server refused by address", "remote", conn.RemoteAddr().String())
+			rejectedServers.Add(1)
+			conn.Close()
+			continue
 		}
 		go newServer(conn)
 	}
+	drainServers(drainTimeout)
+	slog.Info("shut down")
 }
 
 // parsePorts splits up the given string into it's address, low port, and high
@@ -82,22 +307,94 @@ func parsePorts(ports string) (string, int, int, error) {
 	return addr, low, high, nil
 }
 
+// parseWindow parses the window command-line argument.
+func parseWindow(s string) error {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("window must be positive")
+	}
+	window = uint32(n)
+	return nil
+}
+
 // findUnusedPort finds a port not in use in the port range given on the command
 // line.
 func findUnusedPort() int {
+	reserved := reservedPorts()
 	upLock.Lock()
 	defer upLock.Unlock()
 	port := -1
 	for x := low; x <= high; x++ {
-		if !usedPorts[x] {
+		if !usedPorts[x] && !reserved[x] {
 			port = x
+			usedPorts[port] = true
 			break
 		}
 	}
-	usedPorts[port] = true
 	return port
 }
 
+// claimPort marks the given port as used if it's in the port range given on the
+// command line and no other server is using it.
+func claimPort(port int) error {
+	upLock.Lock()
+	defer upLock.Unlock()
+	if port < low || port > high {
+		return ErrPortNotAllowed
+	}
+	if usedPorts[port] {
+		return ErrPortInUse
+	}
+	usedPorts[port] = true
+	return nil
+}
+
+// portRange returns the address and port range given on the command line or
+// in the config.
+func portRange() (string, int, int) {
+	upLock.Lock()
+	defer upLock.Unlock()
+	return saddr, low, high
+}
+
+// setPortRange changes the address and port range new ports are handed out
+// from. Ports in use outside of it stay in use until they're released.
+func setPortRange(addr string, l, h int) {
+	upLock.Lock()
+	defer upLock.Unlock()
+	saddr, low, high = addr, l, h
+}
+
+// servicePort returns the port the given service last registered with or zero
+// if it hasn't.
+func servicePort(service string) int {
+	upLock.Lock()
+	defer upLock.Unlock()
+	return services[service]
+}
+
+// rememberService records the port the given service is using.
+func rememberService(service string, port int) {
+	upLock.Lock()
+	defer upLock.Unlock()
+	services[service] = port
+}
+
+// usedPortList returns the ports in use in order.
+func usedPortList() []int {
+	upLock.Lock()
+	defer upLock.Unlock()
+	used := make([]int, 0, len(usedPorts))
+	for port := range usedPorts {
+		used = append(used, port)
+	}
+	slices.Sort(used)
+	return used
+}
+
 // releasePort removes the given port from the used ports so new server
 // connections can use it.
 func releasePort(port int) {
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// bytesFromClients and bytesToClients count the bytes relayed each way.
+	bytesFromClients atomic.Uint64
+	bytesToClients   atomic.Uint64
+
+	// decodeErrors counts the messages from servers we couldn't decode.
+	decodeErrors atomic.Uint64
+
+	// clientDurations and serverDurations are how long clients and servers
+	// stayed connected in seconds.
+	clientDurations = newHistogram(0.1, 1, 10, 60, 300, 1800, 3600, 6*3600, 24*3600)
+	serverDurations = newHistogram(1, 60, 600, 3600, 6*3600, 24*3600, 7*24*3600)
+)
+
+// histogram counts observations in buckets the way Prometheus expects.
+type histogram struct {
+	lock sync.Mutex
+	// counts[i] is how many observations were at most bounds[i] and more than
+	// the bound before it. The last one is for those above every bound.
+	bounds []float64
+	counts []uint64
+	sum    float64
+}
+
+// newHistogram returns a histogram with buckets for the given upper bounds in
+// increasing order.
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe adds v to the histogram.
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.lock.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.lock.Unlock()
+}
+
+// write writes the histogram in the Prometheus text format.
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.lock.Lock()
+	counts := slices.Clone(h.counts)
+	sum := h.sum
+	h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", name, help, name)
+	var total uint64
+	for i, bound := range h.bounds {
+		total += counts[i]
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, strconv.FormatFloat(bound, 'g', -1, 64), total)
+	}
+	total += counts[len(h.bounds)]
+	fmt.Fprintf(w, "%v_bucket{le=\"+Inf\"} %v\n", name, total)
+	fmt.Fprintf(w, "%v_sum %v\n%v_count %v\n", name, strconv.FormatFloat(sum, 'g', -1, 64), name, total)
+}
+
+// writeMetric writes a metric without labels in the Prometheus text format.
+func writeMetric(w io.Writer, name, kind, help string, v any) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, kind, name, v)
+}
+
+// serveMetrics writes the relay's metrics in the Prometheus text format.
+func serveMetrics(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w := bufio.NewWriter(rw)
+	defer w.Flush()
+
+	all := allServers()
+	slices.SortFunc(all, func(a, b *server) int { return cmp.Compare(a.id, b.id) })
+	writeMetric(w, "tcprelay_servers", "gauge", "The servers being relayed for.", len(all))
+
+	clients := map[string]int{}
+	for _, s := range all {
+		s.countClients(clients)
+	}
+	ports := make([]string, 0, len(clients))
+	for port := range clients {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	fmt.Fprintf(w, "# HELP tcprelay_clients The clients connected to each public port.\n# TYPE tcprelay_clients gauge\n")
+	for _, port := range ports {
+		fmt.Fprintf(w, "tcprelay_clients{port=%q} %v\n", port, clients[port])
+	}
+
+	// Ports outside of the range after a reload don't count.
+	_, low, high := portRange()
+	used := 0
+	for _, port := range usedPortList() {
+		if port >= low && port <= high {
+			used++
+		}
+	}
+	writeMetric(w, "tcprelay_ports", "gauge", "The ports in the port range.", high-low+1)
+	writeMetric(w, "tcprelay_ports_used", "gauge", "The ports in the port range handed out to servers.", used)
+	writeMetric(w, "tcprelay_ports_free", "gauge", "The ports in the port range left to hand out.", high-low+1-used)
+
+	fmt.Fprintf(w, "# HELP tcprelay_bytes_total The bytes relayed between clients and servers.\n# TYPE tcprelay_bytes_total counter\n")
+	fmt.Fprintf(w, "tcprelay_bytes_total{direction=\"from_client\"} %v\n", bytesFromClients.Load())
+	fmt.Fprintf(w, "tcprelay_bytes_total{direction=\"to_client\"} %v\n", bytesToClients.Load())
+
+	fmt.Fprintf(w, "# HELP tcprelay_control_queue The messages waiting to be sent to each server.\n# TYPE tcprelay_control_queue gauge\n")
+	for _, s := range all {
+		fmt.Fprintf(w, "tcprelay_control_queue{server=\"%v\"} %v\n", s.id, s.queued.Load())
+	}
+
+	fmt.Fprintf(w, "# HELP tcprelay_rejected_total The connections refused by address.\n# TYPE tcprelay_rejected_total counter\n")
+	fmt.Fprintf(w, "tcprelay_rejected_total{where=\"public\"} %v\n", rejectedClients.Load())
+	fmt.Fprintf(w, "tcprelay_rejected_total{where=\"control\"} %v\n", rejectedServers.Load())
+
+	fmt.Fprintf(w, "# HELP tcprelay_throttled_seconds_total How long clients waited on the rate limits.\n# TYPE tcprelay_throttled_seconds_total counter\n")
+	fmt.Fprintf(w, "tcprelay_throttled_seconds_total{direction=\"from_client\"} %v\n", time.Duration(throttledFromClients.Load()).Seconds())
+	fmt.Fprintf(w, "tcprelay_throttled_seconds_total{direction=\"to_client\"} %v\n", time.Duration(throttledToClients.Load()).Seconds())
+
+	writeMetric(w, "tcprelay_decode_errors_total", "counter", "The messages from servers that couldn't be decoded.", decodeErrors.Load())
+	clientDurations.write(w, "tcprelay_client_duration_seconds", "How long clients stayed connected.")
+	serverDurations.write(w, "tcprelay_server_duration_seconds", "How long servers stayed connected.")
+}
+
+// portLabel returns the port clients connect to p on for labeling metrics.
+func (p *publicListener) portLabel() string {
+	if _, port, err := net.SplitHostPort(p.addr); err == nil {
+		return port
+	}
+	return p.addr
+}
+
+// countClients adds the server's clients to counts by the port they came
+// through. Every port the server listens on is counted even without clients.
+func (s *server) countClients(counts map[string]int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, p := range s.listeners {
+		if _, ok := counts[p.portLabel()]; !ok {
+			counts[p.portLabel()] = 0
+		}
+	}
+	for _, c := range s.clients {
+		if p := s.listeners[c.listener]; p != nil {
+			counts[p.portLabel()]++
+		}
+	}
+}
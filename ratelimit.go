@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+var (
+	// serverRate and clientRate are the most bytes per second relayed each
+	// way for all of a server's clients and for each client. Zero means no
+	// limit. They change when the config is reloaded.
+	serverRate atomic.Uint64
+	clientRate atomic.Uint64
+
+	// fromClientsLimit and toClientsLimit limit everything relayed each way.
+	fromClientsLimit = &limiter{}
+	toClientsLimit   = &limiter{}
+
+	// throttledFromClients and throttledToClients count how long clients
+	// waited on the limits in nanoseconds.
+	throttledFromClients atomic.Int64
+	throttledToClients   atomic.Int64
+)
+
+// parseRate parses a number of bytes per second. It may end in k, m or g for
+// KiB, MiB or GiB.
+func parseRate(s string) (uint64, error) {
+	digits, mult := s, uint64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			digits = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseTotalRate parses the rate command-line argument.
+func parseTotalRate(s string) error {
+	n, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	fromClientsLimit.setRate(n)
+	toClientsLimit.setRate(n)
+	return nil
+}
+
+// parseServerRate parses the server-rate command-line argument.
+func parseServerRate(s string) error {
+	n, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	serverRate.Store(n)
+	return nil
+}
+
+// parseClientRate parses the client-rate command-line argument.
+func parseClientRate(s string) error {
+	n, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	clientRate.Store(n)
+	return nil
+}
+
+// setLimits sets up the server's limits from the ones it asked for in msg,
+// its register message, and ours. The lowest one wins.
+func (s *server) setLimits(msg *relay.Message) {
+	sc := serviceSettings(msg.Service)
+	rate := lowestRate(serverRate.Load(), sc.ServerRate, msg.ServerRate)
+	s.fromLimit, s.toLimit = newLimiter(rate), newLimiter(rate)
+	s.clientRate = lowestRate(clientRate.Load(), sc.ClientRate, msg.ClientRate)
+}
+
+// lowestRate returns the lowest of the rates that aren't zero or zero if they
+// all are.
+func lowestRate(rates ...uint64) uint64 {
+	var lowest uint64
+	for _, r := range rates {
+		if r != 0 && (lowest == 0 || r < lowest) {
+			lowest = r
+		}
+	}
+	return lowest
+}
+
+// limiter is a token bucket holding up to a second's worth of bytes. Bytes
+// taken when it's empty are owed and whoever took them waits until they're
+// paid back, so waiters are let through in the order they came.
+type limiter struct {
+	lock sync.Mutex
+	// rate is in bytes per second. Zero means no limit.
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter returns a limiter for rate bytes per second or nil if rate is
+// zero.
+func newLimiter(rate uint64) *limiter {
+	if rate == 0 {
+		return nil
+	}
+	return &limiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// refill adds the tokens earned since it was last called. lock has to be
+// held.
+func (l *limiter) refill() {
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// setRate changes the limit to rate bytes per second.
+func (l *limiter) setRate(rate uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.refill()
+	l.rate = float64(rate)
+	l.tokens = min(l.tokens, l.rate)
+}
+
+// limit returns the limit in bytes per second or zero if there is none.
+func (l *limiter) limit() int {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int(l.rate)
+}
+
+// take takes n bytes from the bucket and returns how long to wait before
+// relaying them.
+func (l *limiter) take(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttle waits until n bytes may be relayed under all of the limits and
+// adds the time it waited to waited. It returns false if done is closed
+// first.
+func throttle(done <-chan struct{}, waited *atomic.Int64, n int, limits ...*limiter) bool {
+	var wait time.Duration
+	for _, l := range limits {
+		wait = max(wait, l.take(n))
+	}
+	if wait == 0 {
+		return true
+	}
+	waited.Add(int64(wait))
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// chunk returns n or, if it's lower, the lowest of the limits so a slow limit
+// relays little and often instead of a lot at once.
+func chunk(n int, limits ...*limiter) int {
+	for _, l := range limits {
+		if r := l.limit(); r > 0 && r < n {
+			n = r
+		}
+	}
+	return n
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint64
+		err  bool
+	}{
+		{s: "0", want: 0},
+		{s: "1500", want: 1500},
+		{s: "64k", want: 64 << 10},
+		{s: "64K", want: 64 << 10},
+		{s: "2m", want: 2 << 20},
+		{s: "1G", want: 1 << 30},
+		{s: "", err: true},
+		{s: "k", err: true},
+		{s: "-1", err: true},
+		{s: "1.5m", err: true},
+		{s: "10mb", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseRate(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseRate(%q) = %v, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseRate(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestLowestRate(t *testing.T) {
+	if got := lowestRate(0, 0); got != 0 {
+		t.Errorf("lowestRate(0, 0) = %v, want 0", got)
+	}
+	if got := lowestRate(0, 300, 100, 200); got != 100 {
+		t.Errorf("lowestRate(0, 300, 100, 200) = %v, want 100", got)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(1000)
+	// A second's worth goes through right away.
+	if wait := l.take(1000); wait != 0 {
+		t.Fatalf("waiting %v for the first second's worth", wait)
+	}
+	// Then it has to be paid back at the rate.
+	if wait := l.take(500); wait < 490*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatalf("waiting %v for 500 bytes at 1000 a second, want about 500ms", wait)
+	}
+	// Whoever comes next waits behind what's owed.
+	if wait := l.take(500); wait < 990*time.Millisecond || wait > time.Second {
+		t.Fatalf("waiting %v behind 500 owed bytes, want about 1s", wait)
+	}
+
+	// Time passing refills the bucket but never past a second's worth.
+	l = newLimiter(1000)
+	l.take(1000)
+	l.last = l.last.Add(-10 * time.Second)
+	if wait := l.take(1000); wait != 0 {
+		t.Fatalf("waiting %v after refilling", wait)
+	}
+	if wait := l.take(1); wait == 0 {
+		t.Fatal("bucket refilled past a second's worth")
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	l := &limiter{}
+	if wait := l.take(1 << 30); wait != 0 {
+		t.Fatalf("waiting %v without a limit", wait)
+	}
+	l.setRate(100)
+	if got := l.limit(); got != 100 {
+		t.Fatalf("limit is %v, want 100", got)
+	}
+	if wait := l.take(100); wait == 0 {
+		t.Fatal("a new limit started out full")
+	}
+	l.setRate(0)
+	if wait := l.take(1 << 30); wait != 0 {
+		t.Fatalf("waiting %v after removing the limit", wait)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *limiter
+	if newLimiter(0) != nil {
+		t.Error("newLimiter(0) isn't nil")
+	}
+	if wait := l.take(1 << 30); wait != 0 {
+		t.Errorf("nil limiter waits %v", wait)
+	}
+	if got := l.limit(); got != 0 {
+		t.Errorf("nil limiter's limit is %v", got)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	var waited atomic.Int64
+	done := make(chan struct{})
+	if !throttle(done, &waited, 100, nil, newLimiter(1000)) {
+		t.Fatal("throttle failed within the limit")
+	}
+	if waited.Load() != 0 {
+		t.Fatalf("waited %v within the limit", time.Duration(waited.Load()))
+	}
+	l := newLimiter(1000)
+	start := time.Now()
+	if !throttle(done, &waited, 1100, l) {
+		t.Fatal("throttle failed")
+	}
+	if took := time.Since(start); took < 90*time.Millisecond {
+		t.Fatalf("took %v to get 100 bytes over the limit at 1000 a second", took)
+	}
+	// Waiting stops when done is closed.
+	close(done)
+	start = time.Now()
+	if throttle(done, &waited, 1000000, l) {
+		t.Fatal("throttle succeeded after done was closed")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("took %v to notice done was closed", took)
+	}
+}
+
+func TestChunk(t *testing.T) {
+	if got := chunk(4096, nil, newLimiter(1000), newLimiter(2000)); got != 1000 {
+		t.Errorf("chunk = %v, want 1000", got)
+	}
+	if got := chunk(4096, nil, newLimiter(10000)); got != 4096 {
+		t.Errorf("chunk = %v, want 4096", got)
+	}
+}
@@ -0,0 +1,38 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+// SignatureMaxAge is how far the Timestamp of a signed hello may be from the
+// relay's clock. It limits how long a captured hello can be replayed.
+const SignatureMaxAge = 5 * time.Minute
+
+// Sign returns the signature a server puts in its hello to prove it knows the
+// secret for identity without sending it. It's the HMAC-SHA256 keyed by secret
+// of "tcprelay\n", the identity, "\n", the timestamp in decimal unix seconds,
+// "\n" and the nonce.
+func Sign(identity string, secret []byte, timestamp int64, nonce string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "tcprelay\n%v\n%v\n%v", identity, timestamp, nonce)
+	return mac.Sum(nil)
+}
+
+// VerifySignature returns true if the Signature in msg was made with secret.
+// It doesn't check the Timestamp or the Nonce.
+func VerifySignature(msg *Message, secret []byte) bool {
+	return hmac.Equal(msg.Signature, Sign(msg.Identity, secret, msg.Timestamp, msg.Nonce))
+}
+
+// NewNonce returns a random nonce for a signed hello. Servers that share an
+// identity and sign in the same second still send different signatures.
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrFrameTooLarge is returned by the binary decoder when a frame field is
+// larger than MaxDataSize.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// binaryCodec implements the BinaryCodec. Each message is a single frame:
+//
+//	type      1 byte
+//	flags     1 byte
+//	stream id uvarint
+//	data      uvarint length followed by that many bytes
+//	extension uvarint length followed by that many bytes
+//
+// The only flag is flagCompressed (bit 0), which holds the Compressed field.
+// Varints are encoded like encoding/binary.PutUvarint. Unlike the JSON codec,
+// the data is sent as is. The extension holds the JSON encoding of the fields
+// not in the header (e.g. RemoteAddr). It's always empty for data messages so
+// the bulk of the traffic never touches JSON.
+type binaryCodec struct{}
+
+const flagCompressed = 1 << 0
+
+func (binaryCodec) Name() string {
+	return "binary"
+}
+
+func (binaryCodec) NewEncoder(w io.Writer) Encoder {
+	return &binaryEncoder{w: w}
+}
+
+func (binaryCodec) NewDecoder(r io.Reader) Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &binaryDecoder{r: br}
+}
+
+type binaryEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *binaryEncoder) Encode(m *Message) error {
+	// Build the whole frame so it goes out in a single write.
+	var flags byte
+	if m.Compressed {
+		flags |= flagCompressed
+	}
+	b := append(e.buf[:0], byte(m.Type), flags)
+	b = binary.AppendUvarint(b, uint64(m.ID))
+	b = appendBytes(b, m.Data)
+	var ext []byte
+	if m.Type != MessageTypeData {
+		var err error
+		if ext, err = extension(m); err != nil {
+			return err
+		}
+	}
+	b = appendBytes(b, ext)
+	e.buf = b
+	_, err := e.w.Write(b)
+	return err
+}
+
+// extension returns the JSON encoding of the fields of m that aren't part of
+// the frame header.
+func extension(m *Message) ([]byte, error) {
+	e := *m
+	e.Type, e.ID, e.Data, e.Compressed = 0, 0, nil, false
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return nil, err
+	}
+	// Don't bother sending an extension with nothing in it.
+	if string(b) == `{"Type":0}` {
+		return nil, nil
+	}
+	return b, nil
+}
+
+// appendBytes appends p to b prefixed by its length.
+func appendBytes(b, p []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+type binaryDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *binaryDecoder) Decode(m *Message) error {
+	*m = Message{}
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	flags, err := d.r.ReadByte()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	id, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if id > math.MaxUint32 {
+		return fmt.Errorf("stream id %v out of range", id)
+	}
+	data, err := d.readBytes()
+	if err != nil {
+		return err
+	}
+	ext, err := d.readBytes()
+	if err != nil {
+		return err
+	}
+	if len(ext) > 0 {
+		if err := json.Unmarshal(ext, m); err != nil {
+			return fmt.Errorf("decoding extension: %w", err)
+		}
+	}
+	// The header always wins over anything in the extension.
+	m.Type, m.ID, m.Data = MessageType(t), uint32(id), data
+	m.Compressed = flags&flagCompressed != 0
+	return nil
+}
+
+// readBytes reads a length prefixed field. An empty field is returned as nil.
+func (d *binaryDecoder) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if n > MaxDataSize {
+		return nil, fmt.Errorf("%w: %v bytes", ErrFrameTooLarge, n)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(d.r, p); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return p, nil
+}
+
+// unexpectedEOF turns an io.EOF in the middle of a frame into an
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
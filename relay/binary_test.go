@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// testMessage returns a message of type t with the fields the binary codec
+// puts in the header and, for anything but data, some in the extension.
+func testMessage(t MessageType) *Message {
+	m := &Message{Type: t, ID: 7, Data: []byte("payload")}
+	if t == MessageTypeData {
+		m.Compressed = true
+		return m
+	}
+	m.RemoteAddr = "192.0.2.1:1234"
+	m.Capabilities = Capabilities{CapabilityCompression, CapabilityResume}
+	m.Window = DefaultWindow
+	m.Code = ErrorCodeTimeout
+	m.Reason = "because"
+	m.Port = 8080
+	m.Service = "web"
+	m.Allow = []string{"10.0.0.0/8"}
+	m.ServerRate = 1 << 20
+	m.ResumeToken = "token"
+	m.Ack = math.MaxUint64
+	m.Signature = []byte{0, 1, 2}
+	return m
+}
+
+func roundTrip(t *testing.T, m *Message) *Message {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := BinaryCodec.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatalf("%v: encoding: %v", m.Type, err)
+	}
+	dec := BinaryCodec.NewDecoder(&buf)
+	got := &Message{}
+	if err := dec.Decode(got); err != nil {
+		t.Fatalf("%v: decoding: %v", m.Type, err)
+	}
+	if err := dec.Decode(&Message{}); err != io.EOF {
+		t.Errorf("%v: decoding past the frame: got %v, want %v", m.Type, err, io.EOF)
+	}
+	return got
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	for _, s := range Spec {
+		m := testMessage(s.Type)
+		if got := roundTrip(t, m); !reflect.DeepEqual(got, m) {
+			t.Errorf("%v: got %+v, want %+v", s.Type, got, m)
+		}
+	}
+}
+
+func TestBinaryPayloads(t *testing.T) {
+	large := bytes.Repeat([]byte{0xff}, MaxDataSize)
+	tests := []struct {
+		name string
+		m    *Message
+	}{
+		{"empty data", &Message{Type: MessageTypeData, ID: 1}},
+		{"large data", &Message{Type: MessageTypeData, ID: 1, Data: large}},
+		{"largest id", &Message{Type: MessageTypeData, ID: math.MaxUint32, Data: []byte("x")}},
+		{"no extension", &Message{Type: MessageTypePing}},
+		{"only extension", &Message{Type: MessageTypeError, Code: ErrorCodeTimeout, Reason: "slow"}},
+		{"compressed close", &Message{Type: MessageTypeClose, ID: 3, Compressed: true}},
+	}
+	for _, test := range tests {
+		if got := roundTrip(t, test.m); !reflect.DeepEqual(got, test.m) {
+			t.Errorf("%v: got %+v, want %+v", test.name, got, test.m)
+		}
+	}
+}
+
+func TestBinaryDataSkipsExtension(t *testing.T) {
+	var buf bytes.Buffer
+	m := &Message{Type: MessageTypeData, ID: 1, Data: []byte("abc"), RemoteAddr: "192.0.2.1:1"}
+	if err := BinaryCodec.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{byte(MessageTypeData), 0, 1, 3, 'a', 'b', 'c', 0}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got frame %v, want %v", buf.Bytes(), want)
+	}
+}
+
+func TestBinaryHeaderWins(t *testing.T) {
+	ext := []byte(`{"Type":4,"ID":9,"Data":"eA==","Reason":"x"}`)
+	frame := append([]byte{byte(MessageTypeError), 0, 2, 0}, byte(len(ext)))
+	frame = append(frame, ext...)
+	m := &Message{}
+	if err := BinaryCodec.NewDecoder(bytes.NewReader(frame)).Decode(m); err != nil {
+		t.Fatal(err)
+	}
+	want := &Message{Type: MessageTypeError, ID: 2, Reason: "x"}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %+v, want %+v", m, want)
+	}
+}
+
+func TestBinaryTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := BinaryCodec.NewEncoder(&buf).Encode(testMessage(MessageTypeConnect)); err != nil {
+		t.Fatal(err)
+	}
+	frame := buf.Bytes()
+	for n := 1; n < len(frame); n++ {
+		err := BinaryCodec.NewDecoder(bytes.NewReader(frame[:n])).Decode(&Message{})
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%v of %v bytes: got %v, want %v", n, len(frame), err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestBinaryMalformed(t *testing.T) {
+	uvarint := func(n uint64) []byte {
+		return binary.AppendUvarint(nil, n)
+	}
+	frame := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := []byte{byte(MessageTypeData), 0}
+	overflow := bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"oversized data", frame(header, uvarint(1), uvarint(MaxDataSize+1)), ErrFrameTooLarge},
+		{"oversized extension", frame(header, uvarint(1), uvarint(0), uvarint(MaxDataSize+1)), ErrFrameTooLarge},
+		{"huge length", frame(header, uvarint(1), uvarint(math.MaxUint64)), ErrFrameTooLarge},
+		{"overflowing id", frame(header, overflow), nil},
+		{"overflowing length", frame(header, uvarint(1), overflow), nil},
+		{"id out of range", frame(header, uvarint(math.MaxUint32+1), uvarint(0), uvarint(0)), nil},
+		{"bad extension", frame(header, uvarint(1), uvarint(0), uvarint(2), []byte("{]")), nil},
+	}
+	for _, test := range tests {
+		err := BinaryCodec.NewDecoder(bytes.NewReader(test.frame)).Decode(&Message{})
+		switch {
+		case err == nil:
+			t.Errorf("%v: decoded a malformed frame", test.name)
+		case test.want != nil && !errors.Is(err, test.want):
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			t.Errorf("%v: got %v, want a decoding error", test.name, err)
+		}
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, c := range []Codec{JSONCodec, BinaryCodec} {
+		got, err := CodecByName(c.Name())
+		if err != nil || got != c {
+			t.Errorf("%v: got %v, %v", c.Name(), got, err)
+		}
+	}
+	if _, err := CodecByName("xml"); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("xml: got %v, want %v", err, ErrUnknownCodec)
+	}
+}
@@ -5,32 +5,66 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
-// ErrNotImplemented is returned by the Conn deadline functions as they
-// currently aren't implemented.
-var ErrNotImplemented = errors.New("not implemented")
+// ErrHalfCloseUnsupported is returned by Conn.CloseWrite when the relay
+// doesn't support half-closed connections.
+var ErrHalfCloseUnsupported = errors.New("relay doesn't support half-close")
 
 // Conn implements the net.Conn interface and interacts with relay servers.
 type Conn struct {
+	id   uint32
+	msgs chan *Message
+	// done is closed when msgs won't be read anymore.
+	done  <-chan struct{}
+	laddr *net.TCPAddr
+	raddr *net.TCPAddr
+	// serverName and protocol are what the client negotiated when the relay
+	// terminated TLS for it.
+	serverName string
+	protocol   string
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	// cond guards and signals changes to everything below.
+	cond   *sync.Cond
 	buf    bytes.Buffer
 	closed bool
-	cond   *sync.Cond
-	msgs   chan *Message
-	laddr  *net.TCPAddr
-	raddr  *net.TCPAddr
+	// gone is set when the relay closed the stream. Reads return what's left
+	// in the buffer and writes fail.
+	gone bool
+	// eof is set when the relay shut down its write side. Reads return what's
+	// left in the buffer.
+	eof bool
+	// readClosed and writeClosed are set by CloseRead and CloseWrite.
+	// halfClose is set when the relay supports CloseWrite.
+	readClosed  bool
+	writeClosed bool
+	halfClose   bool
+	// flow is set when the relay does flow control. credit is how much more
+	// we can write and window is how much we buffer for reading. consumed is
+	// how much was read since we last told the relay.
+	flow     bool
+	credit   int
+	window   int
+	consumed int
 }
 
-// NewClient creates a new connection based on the given local and remote
-// addresses. And data that should be sent to the relay will be sent via the
-// given channel.
-func NewClient(localAddr string, remoteAddr string, msgs chan *Message) (*Conn, error) {
+// NewClient creates a new connection for the given stream ID based on the given
+// local and remote addresses. And data that should be sent to the relay will be
+// sent via the given channel.
+func NewClient(id uint32, localAddr string, remoteAddr string, msgs chan *Message) (*Conn, error) {
 	c := &Conn{
+		id:   id,
 		cond: sync.NewCond(&sync.Mutex{}),
 		msgs: msgs,
 	}
+	c.readDeadline = makeDeadline(c.wake)
+	c.writeDeadline = makeDeadline(c.wake)
 	var err error
 	c.laddr, err = net.ResolveTCPAddr("tcp", localAddr)
 	if err != nil {
@@ -43,57 +77,259 @@ func NewClient(localAddr string, remoteAddr string, msgs chan *Message) (*Conn,
 	return c, nil
 }
 
+// FlowControl turns on flow control for the connection. credit is the window
+// the relay advertised and window is the one we advertised.
+func (c *Conn) FlowControl(credit, window uint32) {
+	c.cond.L.Lock()
+	c.flow = true
+	c.credit = int(credit)
+	c.window = int(window)
+	c.cond.L.Unlock()
+}
+
+// HalfClose allows CloseWrite to be used on the connection. It should only be
+// called when the relay supports it.
+func (c *Conn) HalfClose() {
+	c.cond.L.Lock()
+	c.halfClose = true
+	c.cond.L.Unlock()
+}
+
 // Data queues up the given data for reading. Subsequent Read() commands will
 // use the data.
 func (c *Conn) Data(b []byte) {
 	c.cond.L.Lock()
-	c.buf.Write(b)
+	if c.readClosed && c.flow && !c.closed {
+		// Nobody will read it, but the relay still needs to know it has room.
+		c.cond.L.Unlock()
+		c.send(&Message{
+			Type:   MessageTypeWindow,
+			ID:     c.id,
+			Window: uint32(len(b)),
+		})
+		return
+	}
+	if !c.closed && !c.readClosed {
+		c.buf.Write(b)
+	}
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// Grant allows n more bytes to be written when flow control is used.
+func (c *Conn) Grant(n uint32) {
+	c.cond.L.Lock()
+	c.credit += int(n)
 	c.cond.L.Unlock()
 	c.cond.Broadcast()
 }
 
 // Read attempts to fill b with any data in the buffer. If the buffer is empty,
-// it will wait for data to be put using Data().
+// it will wait for data to be put using Data() or for the read deadline.
 func (c *Conn) Read(b []byte) (int, error) {
 	c.cond.L.Lock()
-	for c.buf.Len() < 1 {
-		c.cond.Wait()
+	for {
 		if c.closed {
-			return 0, io.EOF
+			c.cond.L.Unlock()
+			return 0, net.ErrClosed
+		}
+		if c.readDeadline.expired() {
+			c.cond.L.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		if c.buf.Len() > 0 || c.gone || c.eof || c.readClosed {
+			break
+		}
+		c.cond.Wait()
+	}
+	if c.buf.Len() < 1 || c.readClosed {
+		c.cond.L.Unlock()
+		return 0, io.EOF
+	}
+	n, _ := c.buf.Read(b)
+	// Let the relay know once we've made room for a good chunk more. Waiting
+	// for half the window means the relay can't stall waiting on an update
+	// we're holding back.
+	var update int
+	if c.flow && !c.gone && !c.eof {
+		c.consumed += n
+		if c.consumed >= c.window/2 {
+			update, c.consumed = c.consumed, 0
 		}
 	}
-	defer c.cond.L.Unlock()
-	return c.buf.Read(b)
+	c.cond.L.Unlock()
+	if update > 0 {
+		c.send(&Message{
+			Type:   MessageTypeWindow,
+			ID:     c.id,
+			Window: uint32(update),
+		})
+	}
+	return n, nil
 }
 
-// Write writes data to the connection.
+// Write writes data to the connection. When the relay does flow control, it
+// blocks until the relay has room for the data or until the write deadline.
 func (c *Conn) Write(b []byte) (int, error) {
-	// TODO -- error out if we've closed.
-	cp := make([]byte, len(b))
-	copy(cp, b)
-	c.msgs <- &Message{
-		Type:       MessageTypeData,
-		RemoteAddr: c.raddr.String(),
-		LocalAddr:  c.laddr.String(),
-		Data:       cp,
+	written := 0
+	for len(b) > 0 {
+		c.cond.L.Lock()
+		for {
+			if c.closed {
+				c.cond.L.Unlock()
+				return written, net.ErrClosed
+			}
+			if c.gone || c.writeClosed {
+				c.cond.L.Unlock()
+				return written, io.ErrClosedPipe
+			}
+			if c.writeDeadline.expired() {
+				c.cond.L.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			if !c.flow || c.credit > 0 {
+				break
+			}
+			c.cond.Wait()
+		}
+		n := len(b)
+		if n > MaxDataSize {
+			n = MaxDataSize
+		}
+		if c.flow {
+			if n > c.credit {
+				n = c.credit
+			}
+			c.credit -= n
+		}
+		c.cond.L.Unlock()
+		cp := make([]byte, n)
+		copy(cp, b)
+		msg := &Message{
+			Type: MessageTypeData,
+			ID:   c.id,
+			Data: cp,
+		}
+		select {
+		case c.msgs <- msg:
+		case <-c.done:
+			return written, io.ErrClosedPipe
+		case <-c.writeDeadline.wait():
+			// Give back the credit we didn't use.
+			c.Grant(uint32(n))
+			return written, os.ErrDeadlineExceeded
+		}
+		written += n
+		b = b[n:]
 	}
-	return len(b), nil
+	return written, nil
 }
 
 // Close closes the connection and signals the relay that it's being closed.
 func (c *Conn) Close() error {
 	c.cond.L.Lock()
+	if c.closed {
+		c.cond.L.Unlock()
+		return nil
+	}
 	c.closed = true
+	gone := c.gone
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+	// The relay already forgot about the stream if it closed it.
+	if !gone {
+		c.send(&Message{
+			Type: MessageTypeClose,
+			ID:   c.id,
+		})
+	}
+	return nil
+}
+
+// CloseRead shuts down the reading side of the connection. Reads return io.EOF
+// and any data still coming from the relay is discarded.
+func (c *Conn) CloseRead() error {
+	c.cond.L.Lock()
+	if c.closed {
+		c.cond.L.Unlock()
+		return net.ErrClosed
+	}
+	c.readClosed = true
+	// Give back the room taken by anything we're throwing away.
+	update := c.consumed + c.buf.Len()
+	c.consumed = 0
+	c.buf.Reset()
+	flow := c.flow && !c.gone && !c.eof
 	c.cond.L.Unlock()
 	c.cond.Broadcast()
-	c.msgs <- &Message{
-		Type:       MessageTypeClose,
-		RemoteAddr: c.raddr.String(),
-		LocalAddr:  c.laddr.String(),
+	if flow && update > 0 {
+		c.send(&Message{
+			Type:   MessageTypeWindow,
+			ID:     c.id,
+			Window: uint32(update),
+		})
 	}
 	return nil
 }
 
+// CloseWrite shuts down the writing side of the connection. The client sees
+// an EOF once it has read everything written before this.
+func (c *Conn) CloseWrite() error {
+	c.cond.L.Lock()
+	if c.closed {
+		c.cond.L.Unlock()
+		return net.ErrClosed
+	}
+	if !c.halfClose {
+		c.cond.L.Unlock()
+		return ErrHalfCloseUnsupported
+	}
+	send := !c.writeClosed && !c.gone
+	c.writeClosed = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+	if send {
+		c.send(&Message{
+			Type: MessageTypeCloseWrite,
+			ID:   c.id,
+		})
+	}
+	return nil
+}
+
+// send sends msg to the relay unless it's no longer being listened to.
+func (c *Conn) send(msg *Message) {
+	select {
+	case c.msgs <- msg:
+	case <-c.done:
+	}
+}
+
+// closeWriteRemote is called when the relay shuts down the write side of the
+// stream.
+func (c *Conn) closeWriteRemote() {
+	c.cond.L.Lock()
+	c.eof = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// closeRemote is called when the relay closes the stream.
+func (c *Conn) closeRemote() {
+	c.cond.L.Lock()
+	c.gone = true
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
+// wake wakes up any Read or Write waiting on cond. It takes the lock so a
+// waiter can't miss the wake up between checking its deadline and waiting.
+func (c *Conn) wake() {
+	c.cond.L.Lock()
+	c.cond.L.Unlock()
+	c.cond.Broadcast()
+}
+
 // LocalAddr returns the local network address.
 func (c *Conn) LocalAddr() net.Addr {
 	return c.laddr
@@ -104,17 +340,40 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.raddr
 }
 
-// SetDeadline is not implemented and returns that error.
+// ServerName returns the server name the client asked for when the relay
+// terminated TLS for it. It's empty otherwise.
+func (c *Conn) ServerName() string {
+	return c.serverName
+}
+
+// Protocol returns the ALPN protocol the relay negotiated with the client when
+// it terminated TLS for it. It's empty otherwise.
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
+
+// SetDeadline sets both the read and write deadlines.
 func (c *Conn) SetDeadline(t time.Time) error {
-	return ErrNotImplemented
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	c.wake()
+	return nil
 }
 
-// SetReadDeadline is not implemented and returns that error.
+// SetReadDeadline sets the deadline for Read calls, including ones currently
+// blocked. Once it passes, Read fails with an error that has Timeout() set. A
+// zero value for t means Read will not time out.
 func (c *Conn) SetReadDeadline(t time.Time) error {
-	return ErrNotImplemented
+	c.readDeadline.set(t)
+	c.wake()
+	return nil
 }
 
-// SetWriteDeadline is not implemented and returns that error.
+// SetWriteDeadline sets the deadline for Write calls, including ones currently
+// blocked. Once it passes, Write fails with an error that has Timeout() set. A
+// zero value for t means Write will not time out.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
-	return ErrNotImplemented
+	c.writeDeadline.set(t)
+	c.wake()
+	return nil
 }
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrUnknownCodec is returned by ReadCodec and CodecByName when the requested
+// codec isn't one this package knows about.
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Encoder writes messages to a control connection. Encoders aren't safe for
+// concurrent use.
+type Encoder interface {
+	Encode(m *Message) error
+}
+
+// Decoder reads messages from a control connection. Decoders aren't safe for
+// concurrent use.
+type Decoder interface {
+	Decode(m *Message) error
+}
+
+// Codec describes how messages are framed on a control connection. Each
+// control connection picks its codec when it's established (see WriteCodec).
+type Codec interface {
+	// Name is the name the codec is selected by on the wire.
+	Name() string
+
+	// NewEncoder returns an Encoder that writes messages to w.
+	NewEncoder(w io.Writer) Encoder
+
+	// NewDecoder returns a Decoder that reads messages from r.
+	NewDecoder(r io.Reader) Decoder
+}
+
+var (
+	// JSONCodec frames each message as a JSON object. It's the simplest codec
+	// to implement for non-Go servers. Data is base64 encoded.
+	JSONCodec Codec = jsonCodec{}
+
+	// BinaryCodec frames each message as a compact binary frame. See the
+	// binaryCodec documentation for the layout.
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// CodecByName returns the codec with the given name.
+func CodecByName(name string) (Codec, error) {
+	for _, c := range []Codec{JSONCodec, BinaryCodec} {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+}
+
+// WriteCodec writes the codec preamble to w. It is the very first thing a
+// server sends on a new control connection: the codec name followed by a
+// newline (e.g. "json\n"). Every message after it uses that codec in both
+// directions.
+func WriteCodec(w io.Writer, c Codec) error {
+	_, err := io.WriteString(w, c.Name()+"\n")
+	return err
+}
+
+// ReadCodec reads the codec preamble written by WriteCodec from r. The same
+// reader should be used to create the Decoder as it may have buffered messages
+// following the preamble.
+func ReadCodec(r *bufio.Reader) (Codec, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading codec: %w", err)
+	}
+	return CodecByName(strings.TrimSpace(string(line)))
+}
+
+// jsonCodec implements the JSONCodec.
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) NewEncoder(w io.Writer) Encoder {
+	return jsonEncoder{json.NewEncoder(w)}
+}
+
+func (jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return jsonDecoder{json.NewDecoder(r)}
+}
+
+type jsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e jsonEncoder) Encode(m *Message) error {
+	return e.enc.Encode(m)
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d jsonDecoder) Decode(m *Message) error {
+	*m = Message{}
+	return d.dec.Decode(m)
+}
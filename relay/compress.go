@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ErrDecompress is returned by a decompressing Decoder when a message's data
+// couldn't be decompressed.
+var ErrDecompress = errors.New("bad compressed data")
+
+const (
+	// compressMinSize is the smallest payload worth compressing.
+	compressMinSize = 256
+
+	// compressMaxMisses is how many times in a row compressing a stream's data
+	// can fail to make it smaller before we stop trying for that stream.
+	compressMaxMisses = 8
+)
+
+// compressor is an Encoder that compresses the data of data messages before
+// passing them on. It keeps track of how well each stream compresses and
+// stops trying on streams that don't.
+type compressor struct {
+	enc Encoder
+	w   *flate.Writer
+	buf bytes.Buffer
+	// lock guards misses as the decompressor paired with us forgets the
+	// streams the other side closes.
+	lock   sync.Mutex
+	misses map[uint32]int
+}
+
+// NewCompressor returns an Encoder that compresses the data of data messages
+// with DEFLATE before encoding them with enc. It should only be used when
+// CapabilityCompression was agreed to.
+func NewCompressor(enc Encoder) Encoder {
+	c := &compressor{enc: enc, misses: make(map[uint32]int)}
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	return c
+}
+
+// NewCompression returns enc and dec wrapped like NewCompressor and
+// NewDecompressor do. The data of data messages is only compressed if
+// compress is set. Unlike using them on their own, the compressor also
+// forgets about the streams the other side closes.
+func NewCompression(enc Encoder, dec Decoder, compress bool) (Encoder, Decoder) {
+	d := &decompressor{dec: dec}
+	d.r = flate.NewReader(&d.src)
+	if compress {
+		d.compressor = NewCompressor(enc).(*compressor)
+		enc = d.compressor
+	}
+	return enc, d
+}
+
+func (c *compressor) Encode(m *Message) error {
+	switch m.Type {
+	case MessageTypeData:
+		c.lock.Lock()
+		misses := c.misses[m.ID]
+		c.lock.Unlock()
+		if len(m.Data) >= compressMinSize && misses < compressMaxMisses {
+			p := c.compress(m.Data)
+			c.lock.Lock()
+			if p != nil {
+				delete(c.misses, m.ID)
+			} else {
+				c.misses[m.ID]++
+			}
+			c.lock.Unlock()
+			if p != nil {
+				cm := *m
+				cm.Data, cm.Compressed = p, true
+				return c.enc.Encode(&cm)
+			}
+		}
+	case MessageTypeClose:
+		c.forget(m.ID)
+	}
+	return c.enc.Encode(m)
+}
+
+// forget stops keeping track of how well the stream compresses.
+func (c *compressor) forget(id uint32) {
+	c.lock.Lock()
+	delete(c.misses, id)
+	c.lock.Unlock()
+}
+
+// compress returns the compressed version of p or nil if it isn't smaller.
+func (c *compressor) compress(p []byte) []byte {
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := c.w.Write(p); err != nil {
+		return nil
+	}
+	if err := c.w.Close(); err != nil {
+		return nil
+	}
+	if c.buf.Len() >= len(p) {
+		return nil
+	}
+	return bytes.Clone(c.buf.Bytes())
+}
+
+// decompressor is a Decoder that decompresses the data of compressed
+// messages.
+type decompressor struct {
+	dec Decoder
+	r   io.ReadCloser
+	src bytes.Reader
+	// compressor, if set, is told about the streams the other side closes.
+	compressor *compressor
+}
+
+// NewDecompressor returns a Decoder that decodes messages with dec and then
+// decompresses the data of the ones that were compressed. It should only be
+// used when CapabilityCompression was agreed to.
+func NewDecompressor(dec Decoder) Decoder {
+	d := &decompressor{dec: dec}
+	d.r = flate.NewReader(&d.src)
+	return d
+}
+
+func (d *decompressor) Decode(m *Message) error {
+	if err := d.dec.Decode(m); err != nil {
+		return err
+	}
+	if m.Type == MessageTypeClose && d.compressor != nil {
+		d.compressor.forget(m.ID)
+	}
+	if !m.Compressed {
+		return nil
+	}
+	d.src.Reset(m.Data)
+	if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+	// Don't let a small message blow up into a huge one.
+	p, err := io.ReadAll(io.LimitReader(d.r, MaxDataSize+1))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecompress, err)
+	}
+	if len(p) > MaxDataSize {
+		return fmt.Errorf("%w: more than %v bytes", ErrDecompress, MaxDataSize)
+	}
+	m.Data, m.Compressed = p, false
+	return nil
+}
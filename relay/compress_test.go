@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc, dec := NewCompression(JSONCodec.NewEncoder(&buf), JSONCodec.NewDecoder(&buf), true)
+	data := bytes.Repeat([]byte("compress me "), 100)
+	if err := enc.Encode(&Message{Type: MessageTypeData, ID: 1, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(data) {
+		t.Errorf("encoded %v bytes of data into %v", len(data), buf.Len())
+	}
+	m := &Message{}
+	if err := dec.Decode(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Compressed || !bytes.Equal(m.Data, data) {
+		t.Errorf("decoded %q, want %q", m.Data, data)
+	}
+}
+
+func TestCompressionForgetsClosedStreams(t *testing.T) {
+	var buf bytes.Buffer
+	enc, dec := NewCompression(JSONCodec.NewEncoder(&buf), JSONCodec.NewDecoder(&buf), true)
+	c := enc.(*compressor)
+	noise := make([]byte, 1024)
+	rand.Read(noise)
+
+	// Streams that don't compress are remembered until they're closed by
+	// either side.
+	for id := uint32(1); id <= 2; id++ {
+		if err := enc.Encode(&Message{Type: MessageTypeData, ID: id, Data: noise}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.misses) != 2 {
+		t.Fatalf("remembering %v streams, want 2", len(c.misses))
+	}
+	if err := enc.Encode(&Message{Type: MessageTypeClose, ID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := JSONCodec.NewEncoder(&buf).Encode(&Message{Type: MessageTypeClose, ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Decode(&Message{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.misses) != 0 {
+		t.Errorf("still remembering %v closed streams", len(c.misses))
+	}
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a read or write deadline for a Conn. It's modeled after the one
+// used by net.Pipe. The channel returned by wait is closed once the deadline
+// passes and a new one is made if the deadline is moved back into the future.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+	// notify is called when the deadline passes so waiters can wake up.
+	notify func()
+}
+
+func makeDeadline(notify func()) deadline {
+	return deadline{cancel: make(chan struct{}), notify: notify}
+}
+
+// set sets the deadline. A zero value for t means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Wait for a timer that already fired to close the channel.
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel
+	}
+	d.timer = nil
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+			d.notify()
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that's closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// expired returns true if the deadline has passed.
+func (d *deadline) expired() bool {
+	return isClosedChan(d.wait())
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import "fmt"
+
+// ErrorCode is the machine readable reason in a MessageTypeError.
+type ErrorCode int
+
+const (
+	// ErrorCodeNoPorts means the relay has no free ports to give the server.
+	ErrorCodeNoPorts ErrorCode = iota + 1
+
+	// ErrorCodeAuth means the server couldn't be authenticated.
+	ErrorCodeAuth
+
+	// ErrorCodeBind means the relay couldn't listen on the port for the server.
+	ErrorCodeBind
+
+	// ErrorCodeProtocol means the server sent something the protocol doesn't
+	// allow.
+	ErrorCodeProtocol
+
+	// ErrorCodePortInUse means the port the server registered for is being
+	// used by another server.
+	ErrorCodePortInUse
+
+	// ErrorCodePortNotAllowed means the port the server registered for isn't
+	// one the relay hands out.
+	ErrorCodePortNotAllowed
+
+	// ErrorCodeTLS means the relay can't terminate TLS for the server, e.g.
+	// because it has no certificate for it.
+	ErrorCodeTLS
+
+	// ErrorCodeResume means the session the server tried to resume is gone,
+	// e.g. because it took too long to come back.
+	ErrorCodeResume
+
+	// ErrorCodeShutdown means the relay is shutting down and isn't taking new
+	// servers.
+	ErrorCodeShutdown
+
+	// ErrorCodeHostInUse means the hostname the server registered for is being
+	// used by another server.
+	ErrorCodeHostInUse
+
+	// ErrorCodeTimeout means the server took too long to get through the
+	// handshake, e.g. because it didn't send its codec.
+	ErrorCodeTimeout
+)
+
+// String returns the string representation of the given code.
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeNoPorts:
+		return "no ports"
+	case ErrorCodeAuth:
+		return "auth"
+	case ErrorCodeBind:
+		return "bind"
+	case ErrorCodeProtocol:
+		return "protocol"
+	case ErrorCodePortInUse:
+		return "port in use"
+	case ErrorCodePortNotAllowed:
+		return "port not allowed"
+	case ErrorCodeTLS:
+		return "tls"
+	case ErrorCodeResume:
+		return "resume"
+	case ErrorCodeShutdown:
+		return "shutdown"
+	case ErrorCodeHostInUse:
+		return "host in use"
+	case ErrorCodeTimeout:
+		return "timeout"
+	}
+	return fmt.Sprintf("code %d", int(c))
+}
+
+// Error is an error the relay reported with a MessageTypeError. Dial returns
+// one when the relay refuses the server.
+type Error struct {
+	Code   ErrorCode
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("relay error (%v): %v", e.Code, e.Reason)
+}
+
+// errorMessage returns the Error carried by msg.
+func errorMessage(msg *Message) *Error {
+	return &Error{Code: msg.Code, Reason: msg.Reason}
+}
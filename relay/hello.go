@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the relay protocol implemented by this
+// package. The server and relay must speak the same version.
+const ProtocolVersion = 1
+
+var (
+	// ErrVersionMismatch is returned by Dial when the relay speaks a different
+	// protocol version.
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+
+	// ErrUnexpectedMessage is returned when the peer sends a message that isn't
+	// allowed at that point in the protocol.
+	ErrUnexpectedMessage = errors.New("unexpected message")
+)
+
+// Capabilities is a set of optional protocol features. Each side advertises
+// the ones it supports in its hello message and only the ones both sides
+// support are used.
+type Capabilities []string
+
+// Has returns true if name is in the set.
+func (c Capabilities) Has(name string) bool {
+	for _, n := range c {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns the capabilities found in both c and other.
+func (c Capabilities) Negotiate(other Capabilities) Capabilities {
+	var both Capabilities
+	for _, n := range c {
+		if other.Has(n) {
+			both = append(both, n)
+		}
+	}
+	return both
+}
+
+// CapabilityFlowControl means each side limits how much data it sends on a
+// stream to the Window the other side advertised in its hello. The receiver
+// sends MessageTypeWindow as it consumes the data to allow more.
+const CapabilityFlowControl = "flow"
+
+// CapabilityHalfClose means either side may send MessageTypeCloseWrite to
+// shut down the write side of a stream while still reading from it.
+const CapabilityHalfClose = "halfclose"
+
+// CapabilityKeepAlive means either side may send MessageTypePing and the
+// other side answers with MessageTypePong. A side that hasn't heard anything
+// from the other for a while considers the connection dead.
+const CapabilityKeepAlive = "keepalive"
+
+// CapabilityCompression means either side may compress the Data of a
+// MessageTypeData with DEFLATE (RFC 1951) and set Compressed. Each message is
+// compressed on its own and none may decompress to more than MaxDataSize.
+const CapabilityCompression = "deflate"
+
+// CapabilityRegister means the server sends MessageTypeRegister after the
+// hellos to ask for a port before the relay picks one.
+const CapabilityRegister = "register"
+
+// CapabilityTLS means the relay can terminate TLS for the server's clients.
+// The server asks for it in MessageTypeRegister and learns what each client
+// negotiated in MessageTypeConnect.
+const CapabilityTLS = "tls"
+
+// CapabilityResume means the relay keeps the server's port and streams for a
+// while after losing the control connection. The server can reconnect with
+// its ResumeToken and each side sends again the stream messages the other
+// didn't get.
+const CapabilityResume = "resume"
+
+// CapabilityShutdown means the relay sends MessageTypeShutdown before it shuts
+// down so the server knows no more clients are coming.
+const CapabilityShutdown = "shutdown"
+
+// CapabilityListeners means the server can open more public ports on the
+// same control connection with MessageTypeListen.
+const CapabilityListeners = "listeners"
+
+// CapabilityVirtualHost means the relay has a public port shared by servers.
+// It sends each client to the server that registered the hostname the client
+// asked for with TLS SNI or the HTTP Host header.
+const CapabilityVirtualHost = "vhost"
+
+// CapabilityACL means the relay can refuse clients by address. A server can
+// add its own CIDR rules for its ports when registering or listening.
+const CapabilityACL = "acl"
+
+// CapabilityRateLimit means the relay limits the bytes relayed per second. A
+// server can ask for lower limits for itself and its clients when
+// registering.
+const CapabilityRateLimit = "ratelimit"
+
+// supportedCapabilities are the capabilities the Listener implements.
+var supportedCapabilities = Capabilities{
+	CapabilityFlowControl,
+	CapabilityHalfClose,
+	CapabilityKeepAlive,
+	CapabilityCompression,
+	CapabilityRegister,
+	CapabilityTLS,
+	CapabilityResume,
+	CapabilityShutdown,
+	CapabilityListeners,
+	CapabilityVirtualHost,
+	CapabilityACL,
+	CapabilityRateLimit,
+}
+
+// hello sends our hello message to the relay and waits for its reply. The
+// reply's capabilities are narrowed down to the ones we asked for.
+func hello(enc Encoder, dec Decoder, ours *Message) (*Message, error) {
+	if err := enc.Encode(ours); err != nil {
+		return nil, err
+	}
+	msg := &Message{}
+	if err := dec.Decode(msg); err != nil {
+		return nil, fmt.Errorf("reading hello: %w", err)
+	}
+	if msg.Type == MessageTypeError {
+		return nil, errorMessage(msg)
+	}
+	if msg.Type != MessageTypeHello {
+		return nil, fmt.Errorf("%w: %v instead of hello", ErrUnexpectedMessage, msg.Type)
+	}
+	if msg.Version != ProtocolVersion {
+		return nil, fmt.Errorf("%w: relay speaks version %v, we speak %v",
+			ErrVersionMismatch, msg.Version, ProtocolVersion)
+	}
+	// Only trust capabilities we actually asked for.
+	msg.Capabilities = ours.Capabilities.Negotiate(msg.Capabilities)
+	if msg.Capabilities.Has(CapabilityFlowControl) && msg.Window == 0 {
+		return nil, fmt.Errorf("%w: flow control without a window", ErrUnexpectedMessage)
+	}
+	return msg, nil
+}
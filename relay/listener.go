@@ -1,161 +1,752 @@
 package relay
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
 	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrKeepAliveTimeout is returned by Accept when the relay stopped
+	// responding to keepalive pings.
+	ErrKeepAliveTimeout = errors.New("relay stopped responding")
+
+	// ErrRegisterUnsupported is returned by Dial when a port or service was
+	// asked for but the relay doesn't support registering.
+	ErrRegisterUnsupported = errors.New("relay doesn't support registering")
+
+	// ErrTLSUnsupported is returned by Dial when TLS termination was asked for
+	// but the relay can't do it.
+	ErrTLSUnsupported = errors.New("relay doesn't support terminating TLS")
+
+	// ErrVirtualHostUnsupported is returned by Dial when a host was asked for
+	// but the relay has no shared port.
+	ErrVirtualHostUnsupported = errors.New("relay doesn't support virtual hosts")
+
+	// ErrACLUnsupported is returned by Dial when client address rules were
+	// given but the relay can't enforce them.
+	ErrACLUnsupported = errors.New("relay doesn't support client address rules")
+
+	// ErrRateLimitUnsupported is returned by Dial when rate limits were given
+	// but the relay can't enforce them.
+	ErrRateLimitUnsupported = errors.New("relay doesn't support rate limits")
+
+	// ErrRelayShutdown is returned by Accept when the relay shut down after
+	// letting the existing connections finish.
+	ErrRelayShutdown = errors.New("relay shut down")
+)
+
+const (
+	// DefaultKeepAlive is how often keepalive pings are sent when none is
+	// given.
+	DefaultKeepAlive = 30 * time.Second
+
+	// DefaultDialTimeout is how long Dial waits on the relay when no timeout
+	// is given.
+	DefaultDialTimeout = 30 * time.Second
+
+	// keepAliveTimeouts is how many keepalive periods we wait to hear from the
+	// relay by default before declaring it dead.
+	keepAliveTimeouts = 3
+
+	// acceptBacklog is how many clients can wait for Accept. More are closed
+	// so the reader never waits on the application.
+	acceptBacklog = 128
 )
 
 // Listener implements the net.Listener interface in such a way that servers can
 // easily be setup to communicate with the relay.
 type Listener struct {
-	clients map[string]*Conn
+	clients map[uint32]*Conn
 	msgs    chan *Message
 	lock    sync.Mutex
 	wg      sync.WaitGroup
-	conn    net.Conn
-	dec     *json.Decoder
 	in      chan net.Conn
-	close   chan struct{}
+	caps    Capabilities
+	// close is closed once the Listener has been shut down. err is the reason
+	// it was shut down.
+	close     chan struct{}
+	closeOnce sync.Once
+	err       error
+	// lastSeen is when we last heard from the relay in unix nanoseconds.
+	lastSeen atomic.Int64
+	// window is the flow control window we advertised and peerWindow the one
+	// the relay did.
+	window     uint32
+	peerWindow uint32
+	// dialer and addr are what we dialed so we can do it again to resume.
+	dialer Dialer
+	addr   string
+	// linkLock guards the connection to the relay, which changes when we
+	// resume. ack is how many stream messages the relay said it had received
+	// when we did.
+	linkLock sync.Mutex
+	conn     net.Conn
+	enc      Encoder
+	dec      Decoder
+	ack      uint64
+	// token resumes our session. replay holds the stream messages the relay
+	// hasn't acknowledged and received counts the ones it sent us. relinked
+	// tells handleMessagesToRelay we resumed and ackNow that it's time to
+	// acknowledge what we received.
+	token    string
+	replay   Replay
+	received atomic.Uint64
+	relinked chan struct{}
+	ackNow   chan struct{}
+	// stopping is set once we're telling the relay we're done so losing the
+	// connection doesn't make us resume.
+	stopping atomic.Bool
+	// draining is closed when the relay says it's shutting down.
+	draining chan struct{}
+	// ports are the ones opened with Listen by their Listener ID and
+	// lastPort the last ID we used. They're guarded by lock.
+	ports    map[uint32]*Port
+	lastPort uint32
+	// log is the Dialer's Logger with the relay's address.
+	log *slog.Logger
+}
+
+// Dialer contains options for connecting to a relay. The zero value is ready
+// to use.
+type Dialer struct {
+	// Codec is the codec used on the control connection. If nil, BinaryCodec is
+	// used.
+	Codec Codec
+
+	// Window is the number of bytes buffered for reading on each connection
+	// before the relay has to wait for them to be read. If zero, DefaultWindow
+	// is used.
+	Window uint32
+
+	// Timeout is how long Dial waits to connect and get through the TLS
+	// handshake, the hellos and registering. If zero, DefaultDialTimeout is
+	// used. If negative, it waits as long as it takes.
+	Timeout time.Duration
+
+	// KeepAlive is how often a ping is sent to the relay when it supports
+	// keepalives. If zero, DefaultKeepAlive is used. If negative, no pings are
+	// sent.
+	KeepAlive time.Duration
+
+	// KeepAliveTimeout is how long we wait to hear anything from the relay
+	// before giving up on it. If zero, three times KeepAlive is used.
+	KeepAliveTimeout time.Duration
+
+	// DisableCompression stops us from compressing the data we send. We still
+	// accept compressed data from the relay.
+	DisableCompression bool
+
+	// Port is the port we'd like clients to connect to. If zero, the relay
+	// picks one.
+	Port int
+
+	// Service names the server. The relay gives a service the port it had
+	// the last time it registered if Port is zero and the port is free.
+	Service string
+
+	// Fallback lets the relay pick another port if Port can't be used instead
+	// of refusing us.
+	Fallback bool
+
+	// Host asks for the clients of the relay's shared port that want this
+	// hostname, e.g. www.example.com or *.example.com, instead of a port of
+	// our own. They ask with TLS SNI or the HTTP Host header, which we get
+	// to read as usual.
+	Host string
+
+	// Allow and Deny are CIDR prefixes, e.g. 10.0.0.0/8, or single addresses
+	// clients are let in or refused by. A client matching Deny is refused.
+	// If Allow is given, clients that don't match it are refused too. The
+	// relay's own rules still apply.
+	Allow []string
+	Deny  []string
+
+	// ServerRate and ClientRate are the most bytes per second the relay
+	// should relay each way for all of our clients and for each one. Zero
+	// leaves it to the relay, which may have lower limits of its own.
+	ServerRate uint64
+	ClientRate uint64
+
+	// Token is the bearer token sent to relays that require authentication.
+	Token string
+
+	// Identity and Secret are used instead of Token to sign our hello so the
+	// secret is never sent to the relay.
+	Identity string
+	Secret   []byte
+
+	// TLSConfig, if not nil, is used to talk to the relay over TLS. Put a
+	// client certificate in it for relays that require one. The relay then
+	// knows who we are without a token.
+	TLSConfig *tls.Config
+
+	// Pins are the pins (see Pin) of the relay certificates we trust. If any
+	// are given, TLS is used and the relay's certificate must match one. If
+	// TLSConfig is nil, the pins are the only check made on the certificate.
+	Pins [][]byte
+
+	// TerminateTLS asks the relay to terminate TLS for our clients with its
+	// certificate for us. Protocols are the ALPN protocols offered to them.
+	// Conn.ServerName and Conn.Protocol tell us what each client negotiated.
+	TerminateTLS bool
+	Protocols    []string
+
+	// ResumeTimeout is how long we keep trying to resume our session after
+	// losing the connection to a relay that supports it. Clients stay
+	// connected in the meantime. If zero, DefaultResumeTimeout is used. If
+	// negative, the Listener shuts down as soon as the connection is lost.
+	ResumeTimeout time.Duration
+
+	// Logger gets what the Listener has to say along with the relay's
+	// address. If nil, slog.Default() is used. A logger with a handler that
+	// discards everything silences it.
+	Logger *slog.Logger
+}
+
+// Dial connects to a tcprelay server using the given addr:port and the default
+// Dialer options.
+func Dial(addr string) (*Listener, string, error) {
+	var d Dialer
+	return d.Dial(addr)
 }
 
 // Dial connects to a tcprelay server using the given addr:port. It acts as a
 // net.Listener by handling messages from a relay server. It also returns the
 // relay information.
-func Dial(addr string) (*Listener, string, error) {
+func (d *Dialer) Dial(addr string) (*Listener, string, error) {
 	l := &Listener{
-		clients: make(map[string]*Conn),
-		msgs:    make(chan *Message),
-		in:      make(chan net.Conn),
-		close:   make(chan struct{}),
+		clients:  make(map[uint32]*Conn),
+		msgs:     make(chan *Message),
+		in:       make(chan net.Conn, acceptBacklog),
+		close:    make(chan struct{}),
+		window:   d.Window,
+		dialer:   *d,
+		addr:     addr,
+		relinked: make(chan struct{}, 1),
+		ackNow:   make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		ports:    make(map[uint32]*Port),
+		log:      d.Logger,
+	}
+	if l.log == nil {
+		l.log = slog.Default()
+	}
+	l.log = l.log.With("relay", addr)
+	if l.window == 0 {
+		l.window = DefaultWindow
 	}
 	// Make the connection
-	conn, err := net.Dial("tcp", addr)
+	var deadline time.Time
+	switch {
+	case d.Timeout == 0:
+		deadline = time.Now().Add(DefaultDialTimeout)
+	case d.Timeout > 0:
+		deadline = time.Now().Add(d.Timeout)
+	}
+	conn, enc, dec, err := d.open(addr, deadline)
 	if err != nil {
 		return nil, "", err
 	}
-	l.conn = conn
-	// Get the first message.
-	l.dec = json.NewDecoder(conn)
-	msg := &Message{}
-	err = l.dec.Decode(msg)
+	// Agree on the protocol and prove who we are.
+	h, err := hello(enc, dec, d.hello(l.window))
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	l.caps, l.peerWindow = h.Capabilities, h.Window
+	enc, dec = l.compress(enc, dec)
+	// Ask for our port.
+	if d.TerminateTLS && !l.caps.Has(CapabilityTLS) {
+		conn.Close()
+		return nil, "", ErrTLSUnsupported
+	}
+	if d.Host != "" && !l.caps.Has(CapabilityVirtualHost) {
+		conn.Close()
+		return nil, "", ErrVirtualHostUnsupported
+	}
+	if (len(d.Allow) > 0 || len(d.Deny) > 0) && !l.caps.Has(CapabilityACL) {
+		conn.Close()
+		return nil, "", ErrACLUnsupported
+	}
+	if (d.ServerRate > 0 || d.ClientRate > 0) && !l.caps.Has(CapabilityRateLimit) {
+		conn.Close()
+		return nil, "", ErrRateLimitUnsupported
+	}
+	if l.caps.Has(CapabilityRegister) {
+		err := enc.Encode(&Message{
+			Type:       MessageTypeRegister,
+			Port:       d.Port,
+			Service:    d.Service,
+			Fallback:   d.Fallback,
+			TLS:        d.TerminateTLS,
+			Protocols:  d.Protocols,
+			Host:       d.Host,
+			Allow:      d.Allow,
+			Deny:       d.Deny,
+			ServerRate: d.ServerRate,
+			ClientRate: d.ClientRate,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	} else if d.Port != 0 || d.Service != "" {
+		conn.Close()
+		return nil, "", ErrRegisterUnsupported
+	}
+	// Get the relay message.
+	msg, err := readRelay(dec)
 	if err != nil {
-		l.conn.Close()
-		return nil, "", errors.New("failed to decode relay message")
-	} else if msg.Type != MessageTypeRelay {
-		return nil, "", errors.New("relay message wasn't the first message")
+		conn.Close()
+		return nil, "", err
 	}
+	conn.SetDeadline(time.Time{})
+	l.conn, l.enc, l.dec, l.token = conn, enc, dec, msg.ResumeToken
 	// Startup the goroutines that listen for messages and return.
+	l.lastSeen.Store(time.Now().UnixNano())
+	l.wg.Add(2)
 	go l.handleMessagesToRelay()
 	go l.handleMessagesFromRelay()
+	if l.caps.Has(CapabilityKeepAlive) && d.KeepAlive >= 0 {
+		interval, timeout := d.KeepAlive, d.KeepAliveTimeout
+		if interval == 0 {
+			interval = DefaultKeepAlive
+		}
+		if timeout == 0 {
+			timeout = keepAliveTimeouts * interval
+		}
+		l.wg.Add(1)
+		go l.keepAlive(interval, timeout)
+	}
 	return l, string(msg.Data), nil
 }
 
+// open connects to the relay at addr and tells it which codec we speak. The
+// deadline, if not zero, applies to the connection until it's cleared.
+func (d *Dialer) open(addr string, deadline time.Time) (net.Conn, Encoder, Decoder, error) {
+	codec := d.Codec
+	if codec == nil {
+		codec = BinaryCodec
+	}
+	nd := &net.Dialer{Deadline: deadline}
+	conn, err := nd.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conn.SetDeadline(deadline)
+	if d.TLSConfig != nil || len(d.Pins) > 0 {
+		tc, err := d.tlsClient(conn, addr)
+		if err != nil {
+			conn.Close()
+			return nil, nil, nil, err
+		}
+		conn = tc
+	}
+	if err := WriteCodec(conn, codec); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, codec.NewEncoder(conn), codec.NewDecoder(conn), nil
+}
+
+// hello returns the hello we send the relay, signed if we have a secret.
+func (d *Dialer) hello(window uint32) *Message {
+	caps := supportedCapabilities
+	if d.ResumeTimeout < 0 {
+		caps = slices.DeleteFunc(slices.Clone(caps), func(c string) bool {
+			return c == CapabilityResume
+		})
+	}
+	ours := &Message{
+		Type:         MessageTypeHello,
+		Version:      ProtocolVersion,
+		Capabilities: caps,
+		Window:       window,
+		Token:        d.Token,
+	}
+	if d.Identity != "" {
+		ours.Identity, ours.Timestamp, ours.Nonce = d.Identity, time.Now().Unix(), NewNonce()
+		ours.Signature = Sign(ours.Identity, d.Secret, ours.Timestamp, ours.Nonce)
+	}
+	return ours
+}
+
+// compress wraps enc and dec for compression if it was agreed to.
+func (l *Listener) compress(enc Encoder, dec Decoder) (Encoder, Decoder) {
+	if !l.caps.Has(CapabilityCompression) {
+		return enc, dec
+	}
+	return NewCompression(enc, dec, !l.dialer.DisableCompression)
+}
+
+// readRelay reads the relay message that ends the handshake.
+func readRelay(dec Decoder) (*Message, error) {
+	msg := &Message{}
+	if err := dec.Decode(msg); err != nil {
+		return nil, errors.New("failed to decode relay message")
+	}
+	if msg.Type == MessageTypeError {
+		return nil, errorMessage(msg)
+	}
+	if msg.Type != MessageTypeRelay {
+		return nil, errors.New("relay message wasn't the first message")
+	}
+	return msg, nil
+}
+
+// link returns the connection to the relay.
+func (l *Listener) link() (net.Conn, Encoder, Decoder) {
+	l.linkLock.Lock()
+	defer l.linkLock.Unlock()
+	return l.conn, l.enc, l.dec
+}
+
+// shutdown closes the connection to the relay and every connection that came
+// through it. Accept returns err from then on.
+func (l *Listener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.close)
+		conn, _, _ := l.link()
+		conn.Close()
+		// We won't hear from the relay about these anymore.
+		l.lock.Lock()
+		for id, c := range l.clients {
+			c.closeRemote()
+			delete(l.clients, id)
+		}
+		l.lock.Unlock()
+	})
+}
+
+// send queues msg for the relay. It returns false if the Listener was shut
+// down.
+func (l *Listener) send(msg *Message) bool {
+	select {
+	case l.msgs <- msg:
+		return true
+	case <-l.close:
+		return false
+	}
+}
+
+// keepAlive pings the relay every interval and gives up on the connection if
+// we haven't heard anything from the relay within timeout. Unless we can
+// resume, that shuts down the Listener.
+func (l *Listener) keepAlive(interval, timeout time.Duration) {
+	defer l.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.close:
+			return
+		case <-t.C:
+		}
+		last := time.Unix(0, l.lastSeen.Load())
+		if time.Since(last) > timeout {
+			if !l.caps.Has(CapabilityResume) {
+				l.shutdown(fmt.Errorf("%w: nothing heard since %v", ErrKeepAliveTimeout, last))
+				return
+			}
+			// The reader notices and resumes on a new connection.
+			l.log.Warn("nothing heard from the relay, resuming", "last_seen", last)
+			conn, _, _ := l.link()
+			conn.Close()
+			continue
+		}
+		l.send(&Message{Type: MessageTypePing})
+	}
+}
+
 func (l *Listener) handleMessagesToRelay() {
-	l.wg.Add(1)
 	defer l.wg.Done()
+	resume := l.caps.Has(CapabilityResume)
+	conn, enc, _ := l.link()
+	// up is false once writing failed until we resume. acked is what we last
+	// told the relay we received.
+	up := true
+	var acked uint64
+	var acks <-chan time.Time
+	if resume {
+		t := time.NewTicker(AckInterval)
+		defer t.Stop()
+		acks = t.C
+	}
+	write := func(msg *Message) {
+		if !up {
+			return
+		}
+		if err := enc.Encode(msg); err != nil {
+			// Closing the connection makes the reader resume.
+			l.log.Info("writing to the relay failed", "type", msg.Type, "err", err)
+			conn.Close()
+			up = false
+		}
+	}
 	for {
-		// Wait for messages.
-		msg, ok := <-l.msgs
-		if !ok {
+		// Wait for messages. Without a connection, we only take as many as
+		// we're willing to keep.
+		msgs := l.msgs
+		if !up && l.replay.Size() >= resumeBuffer {
+			msgs = nil
+		}
+		var msg *Message
+		select {
+		case msg = <-msgs:
+		case <-l.relinked:
+			// Send whatever the relay missed on the new connection.
+			var ack uint64
+			l.linkLock.Lock()
+			conn, enc, ack = l.conn, l.enc, l.ack
+			l.linkLock.Unlock()
+			up, acked = true, 0
+			missed, err := l.replay.Since(ack)
+			if err != nil {
+				l.shutdown(err)
+				return
+			}
+			for _, m := range missed {
+				write(m)
+			}
+			continue
+		case <-acks:
+		case <-l.ackNow:
+		case <-l.close:
 			return
 		}
+		if msg == nil {
+			if n := l.received.Load(); n > acked {
+				write(&Message{Type: MessageTypeAck, Ack: n})
+				acked = n
+			}
+			continue
+		}
 		// If we got a close mesage, we need to remove it from our client list.
 		if msg.Type == MessageTypeClose {
 			l.lock.Lock()
-			c := l.clients[msg.RemoteAddr]
+			c := l.clients[msg.ID]
 			if c == nil {
-				log.Printf("no connection to %v, not closed.", msg.RemoteAddr)
+				l.log.Debug("no stream, not closed", "stream", msg.ID)
 				l.lock.Unlock()
 				continue
 			}
-			delete(l.clients, msg.RemoteAddr)
+			delete(l.clients, msg.ID)
 			l.lock.Unlock()
 		}
-		// Encode the messsage and write it to our relay.
-		b, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("marshalling relay %v: %v", msg, err)
-			continue
+		if msg.Type == MessageTypeStop {
+			l.stopping.Store(true)
 		}
-		if _, err := l.conn.Write(b); err != nil {
-			log.Printf("writing %v: %v", msg, err)
+		if !resume {
+			// Encode the messsage and write it to our relay.
+			if err := enc.Encode(msg); err != nil {
+				l.shutdown(fmt.Errorf("writing %v: %w", msg, err))
+				return
+			}
+		} else {
+			if msg.Replayable() {
+				l.replay.Add(msg)
+			}
+			write(msg)
+		}
+		// We're done once the relay knows we're stopping. If we lost the
+		// connection, the relay gives up on us by itself.
+		if msg.Type == MessageTypeStop {
+			l.shutdown(net.ErrClosed)
 			return
 		}
 	}
 }
 
 func (l *Listener) handleMessagesFromRelay() {
-	l.wg.Add(1)
 	defer l.wg.Done()
-	msg := &Message{}
+	resume := l.caps.Has(CapabilityResume)
+	_, _, dec := l.link()
 	for {
 		// Get the next message.
-		err := l.dec.Decode(msg)
+		msg := &Message{}
+		err := dec.Decode(msg)
 		if err != nil {
-			log.Fatalln("getting relay:", err)
+			if isClosedChan(l.draining) {
+				l.shutdown(ErrRelayShutdown)
+				return
+			}
+			if !resume {
+				l.shutdown(fmt.Errorf("getting relay: %w", err))
+				return
+			}
+			if dec, err = l.reconnect(err); err != nil {
+				l.shutdown(err)
+				return
+			}
 			continue
 		}
+		l.lastSeen.Store(time.Now().UnixNano())
+		if resume && msg.Replayable() {
+			// Acknowledge in batches. The writer also does it every so often.
+			if l.received.Add(1)%AckEvery == 0 {
+				select {
+				case l.ackNow <- struct{}{}:
+				default:
+				}
+			}
+		}
 		switch msg.Type {
 		case MessageTypeConnect:
 			// Create a new client.
-			c, err := NewClient(msg.LocalAddr, msg.RemoteAddr, l.msgs)
+			c, err := NewClient(msg.ID, msg.LocalAddr, msg.RemoteAddr, l.msgs)
 			if err != nil {
-				log.Printf("making new connection %v: %v", msg, err)
+				l.log.Error("making new connection", "stream", msg.ID, "err", err)
 				continue
 			}
-			// Add it to our mapping and notify the listener.
+			c.done = l.close
+			c.serverName, c.protocol = msg.ServerName, msg.Protocol
+			if l.caps.Has(CapabilityFlowControl) {
+				c.FlowControl(l.peerWindow, l.window)
+			}
+			if l.caps.Has(CapabilityHalfClose) {
+				c.HalfClose()
+			}
+			// Add it to our mapping and notify the listener or port it
+			// came through. It's queued under lock so a port being closed
+			// either gets it before it's forgotten or not at all. We don't
+			// wait on Accept or we'd stop reading pongs and everyone else's
+			// data.
+			in, queued := l.in, false
 			l.lock.Lock()
-			l.clients[msg.RemoteAddr] = c
+			l.clients[msg.ID] = c
+			if msg.Listener != 0 {
+				// A nil port was closed while the client was on its way.
+				in = nil
+				if p := l.ports[msg.Listener]; p != nil {
+					in = p.in
+				}
+			}
+			if in != nil {
+				select {
+				case in <- c:
+					queued = true
+				default:
+					l.log.Warn("too many clients waiting to be accepted", "stream", msg.ID)
+				}
+			}
 			l.lock.Unlock()
-			l.in <- c
+			if !queued {
+				c.Close()
+			}
 		case MessageTypeData:
 			// Send data to the client.
 			l.lock.Lock()
-			c := l.clients[msg.RemoteAddr]
+			c := l.clients[msg.ID]
 			l.lock.Unlock()
 			if c == nil {
-				log.Printf("no connection to %v, data not sent.", msg.RemoteAddr)
+				l.log.Debug("no stream, data not sent", "stream", msg.ID)
 				continue
 			}
 			c.Data(msg.Data)
+		case MessageTypeWindow:
+			l.lock.Lock()
+			c := l.clients[msg.ID]
+			l.lock.Unlock()
+			if c == nil {
+				// It probably closed while the update was in flight.
+				continue
+			}
+			c.Grant(msg.Window)
+		case MessageTypeCloseWrite:
+			l.lock.Lock()
+			c := l.clients[msg.ID]
+			l.lock.Unlock()
+			if c == nil {
+				l.log.Debug("no stream, not closed for writing", "stream", msg.ID)
+				continue
+			}
+			c.closeWriteRemote()
 		case MessageTypeClose:
 			l.lock.Lock()
-			c := l.clients[msg.RemoteAddr]
+			c := l.clients[msg.ID]
+			delete(l.clients, msg.ID)
 			l.lock.Unlock()
 			if c == nil {
-				log.Printf("not connection to %v, not closed.", msg.RemoteAddr)
+				l.log.Debug("no stream, not closed", "stream", msg.ID)
+				continue
+			}
+			c.closeRemote()
+		case MessageTypePing:
+			l.send(&Message{Type: MessageTypePong})
+		case MessageTypePong:
+			// Hearing from the relay is all we wanted.
+		case MessageTypeAck:
+			if err := l.replay.Ack(msg.Ack); err != nil {
+				l.shutdown(err)
+				return
+			}
+		case MessageTypeShutdown:
+			l.log.Info("relay shutting down", "deadline", time.Unix(msg.Timestamp, 0), "reason", msg.Reason)
+			if !isClosedChan(l.draining) {
+				close(l.draining)
+			}
+		case MessageTypeRelay:
+			// It's the answer to a Listen.
+			l.answer(msg.Listener, string(msg.Data), nil)
+		case MessageTypeError:
+			if msg.Listener != 0 {
+				l.answer(msg.Listener, "", errorMessage(msg))
 				continue
 			}
-			c.Close() // This will notify the relay and remove it from the mapping.
+			l.log.Error("relay sent an error", "err", errorMessage(msg))
 		default:
-			log.Printf("unrecognized relay: %v", msg)
+			l.log.Warn("unrecognized message", "type", msg.Type)
 		}
 	}
 }
 
 // Accept implements the net.Conn interface. New connections from the relay will
-// result in this returning a new compatible net.Conn.
+// result in this returning a new compatible net.Conn. Clients of ports opened
+// with Listen are returned by those instead. Once the Listener is closed or the
+// connection to the relay is lost, it returns the reason.
 func (l *Listener) Accept() (net.Conn, error) {
 	select {
 	case <-l.close:
-		return nil, errors.New("closed")
+		return nil, l.err
 	case conn := <-l.in:
 		return conn, nil
 	}
 }
 
-// Close stops this Listener and will signal Accept() to stop if it's waiting.
+// Close tells the relay to stop relaying for us, closes all the connections
+// and will signal Accept() to stop if it's waiting.
 func (l *Listener) Close() error {
-	close(l.close)
+	l.send(&Message{Type: MessageTypeStop})
+	<-l.close
 	l.wg.Wait()
 	return nil
 }
 
+// Draining returns a channel that's closed when the relay says it's shutting
+// down. No more connections will be accepted but the existing ones keep
+// working for a while. Once the relay is gone, Accept returns
+// ErrRelayShutdown.
+func (l *Listener) Draining() <-chan struct{} {
+	return l.draining
+}
+
+// Capabilities returns the optional protocol features both this Listener and
+// the relay agreed to use.
+func (l *Listener) Capabilities() Capabilities {
+	return l.caps
+}
+
 // Addr implements the net.Conn interface. It currently returns the address of
 // the connection to the relay.
 func (l *Listener) Addr() net.Addr {
-	return l.conn.RemoteAddr()
+	conn, _, _ := l.link()
+	return conn.RemoteAddr()
 }
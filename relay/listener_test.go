@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// stalledRelay accepts connections and never says anything.
+func stalledRelay(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Hang up once the listener is closed.
+			defer conn.Close()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Dialer
+	}{
+		{"hello", Dialer{Timeout: 100 * time.Millisecond}},
+		{"TLS handshake", Dialer{Timeout: 100 * time.Millisecond, TLSConfig: &tls.Config{InsecureSkipVerify: true}}},
+	}
+	for _, test := range tests {
+		addr := stalledRelay(t)
+		start := time.Now()
+		_, _, err := test.d.Dial(addr)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("%v: dialing a stalled relay: %v, want a timeout", test.name, err)
+		}
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("%v: took %v to time out", test.name, took)
+		}
+	}
+}
+
+// testLink is the relay's end of a control connection in tests.
+type testLink struct {
+	conn  net.Conn
+	enc   Encoder
+	dec   Decoder
+	hello *Message
+}
+
+// acceptLink accepts a server on ln, answers its hello agreeing to resume and
+// sends it relay as the relay message.
+func acceptLink(t *testing.T, ln net.Listener, relay *Message) *testLink {
+	t.Helper()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	codec, err := ReadCodec(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link := &testLink{conn: conn, enc: codec.NewEncoder(conn), dec: codec.NewDecoder(r), hello: &Message{}}
+	if err := link.dec.Decode(link.hello); err != nil {
+		t.Fatal(err)
+	}
+	link.send(t, &Message{Type: MessageTypeHello, Version: ProtocolVersion, Capabilities: Capabilities{CapabilityResume}})
+	link.send(t, relay)
+	return link
+}
+
+func (link *testLink) send(t *testing.T, msg *Message) {
+	t.Helper()
+	if err := link.enc.Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next stream message from the server, skipping its acks.
+func (link *testLink) next(t *testing.T) *Message {
+	t.Helper()
+	for {
+		msg := &Message{}
+		if err := link.dec.Decode(msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != MessageTypeAck {
+			return msg
+		}
+	}
+}
+
+// expectData fails unless the server sends data on stream id next.
+func (link *testLink) expectData(t *testing.T, id uint32, data string) {
+	t.Helper()
+	msg := link.next(t)
+	if msg.Type != MessageTypeData || msg.ID != id || string(msg.Data) != data {
+		t.Fatalf("got %v %v %q, want data %v %q", msg.Type, msg.ID, msg.Data, id, data)
+	}
+}
+
+func TestListenerResumes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type dialed struct {
+		l   *Listener
+		err error
+	}
+	done := make(chan dialed)
+	go func() {
+		d := &Dialer{
+			ResumeTimeout: 5 * time.Second,
+			Logger:        slog.New(slog.DiscardHandler),
+		}
+		l, _, err := d.Dial(ln.Addr().String())
+		done <- dialed{l, err}
+	}()
+	link := acceptLink(t, ln, &Message{Type: MessageTypeRelay, Data: []byte(":1"), ResumeToken: "token"})
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	l := res.l
+	defer l.Close()
+
+	// A client sends and gets some data.
+	link.send(t, &Message{Type: MessageTypeConnect, ID: 1, LocalAddr: "127.0.0.1:1", RemoteAddr: "127.0.0.1:2"})
+	link.send(t, &Message{Type: MessageTypeData, ID: 1, Data: []byte("ab")})
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	read := func(want string) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != want {
+			t.Fatalf("client read %q, %v, want %q", got, err, want)
+		}
+	}
+	read("ab")
+	for _, p := range []string{"x", "y", "z"} {
+		if _, err := conn.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+		link.expectData(t, 1, p)
+	}
+
+	// The connection breaks after the relay acknowledged x. It then says it
+	// only got y before that so z is all that should be sent again.
+	link.send(t, &Message{Type: MessageTypeAck, Ack: 1})
+	link.conn.Close()
+	link = acceptLink(t, ln, &Message{Type: MessageTypeRelay, Data: []byte(":1"), Ack: 2})
+	if link.hello.ResumeToken != "token" || link.hello.Ack != 2 {
+		t.Errorf("resumed with token %q and ack %v, want %q and 2", link.hello.ResumeToken, link.hello.Ack, "token")
+	}
+	link.expectData(t, 1, "z")
+
+	// The stream carries on both ways without anything repeated.
+	if _, err := conn.Write([]byte("w")); err != nil {
+		t.Fatal(err)
+	}
+	link.expectData(t, 1, "w")
+	link.send(t, &Message{Type: MessageTypeData, ID: 1, Data: []byte("c")})
+	read("c")
+}
@@ -22,6 +22,28 @@ func (t MessageType) String() string {
 		return "data"
 	case MessageTypeClose:
 		return "close"
+	case MessageTypeHello:
+		return "hello"
+	case MessageTypeWindow:
+		return "window"
+	case MessageTypeCloseWrite:
+		return "closewrite"
+	case MessageTypeError:
+		return "error"
+	case MessageTypePing:
+		return "ping"
+	case MessageTypePong:
+		return "pong"
+	case MessageTypeRegister:
+		return "register"
+	case MessageTypeAck:
+		return "ack"
+	case MessageTypeShutdown:
+		return "shutdown"
+	case MessageTypeListen:
+		return "listen"
+	case MessageTypeUnlisten:
+		return "unlisten"
 	}
 	return ""
 }
@@ -29,7 +51,8 @@ func (t MessageType) String() string {
 const (
 	// MessageTypeRelay is the first message the relay sends to the server. It's
 	// data is a utf8 byte-encoded string (e.g. string(m.Data)) that contains the
-	// addr:port that clients can use to connect.
+	// addr:port that clients can use to connect. With CapabilityListeners, the
+	// relay also sends it with the Listener set to answer MessageTypeListen.
 	MessageTypeRelay MessageType = iota
 
 	// MessageTypeStop is a signal from the server that the relay should shutdown
@@ -37,30 +60,187 @@ const (
 	MessageTypeStop
 
 	// MessageTypeConnect is a signal from the relay to the server that a new
-	// connection is being made. The RemoteAddr and LocalAddr will contain the
-	// client information and should be used for future communication to the
-	// client.
+	// connection is being made. The ID is the stream ID the relay assigned to
+	// the client and should be used for future communication to the client. The
+	// RemoteAddr and LocalAddr contain the client's addresses. They are only
+	// ever sent in this message. When the relay terminates TLS for the server,
+	// ServerName and Protocol are the SNI and ALPN protocol the client asked
+	// for. With CapabilityListeners, Listener is the one the client connected
+	// to.
 	MessageTypeConnect
 
 	// MessageTypeData is how the server and relay transfer data to and from
-	// clients. The RemoteAddr and LocalAddr should be filled and the Data contains
-	// the new data to process.
+	// clients. The ID should be filled and the Data contains the new data to
+	// process.
 	MessageTypeData
 
 	// MessageTypeClose is how the server and relay signal that a client is or
-	// should be closed. The RemoteAddr and LocalAddr should contain the client
-	// information that should be closed.
+	// should be closed. The ID is the stream that should be closed.
 	MessageTypeClose
+
+	// MessageTypeHello is the first message on a control connection after the
+	// codec has been chosen. The server sends its Version and the Capabilities
+	// it supports. The relay replies with its own Version and the Capabilities
+	// both sides support. If the versions differ, the relay closes the
+	// connection after replying. With CapabilityFlowControl, Window is the
+	// number of bytes the sender will buffer for each stream. If the relay
+	// requires authentication, the server's hello carries its credentials and
+	// the relay sends MessageTypeError instead of replying if they're wrong. A
+	// server resuming a session with CapabilityResume sets ResumeToken and Ack
+	// and doesn't register again.
+	MessageTypeHello
+
+	// MessageTypeWindow is sent by either side for a stream when flow control
+	// is used. It allows the other side to send Window more bytes of data on
+	// stream ID. Each stream starts with the window advertised in the hello.
+	MessageTypeWindow
+
+	// MessageTypeCloseWrite is sent by either side when CapabilityHalfClose is
+	// used to signal it won't send any more data on stream ID. The other
+	// direction keeps working. Even if both directions are shut down, the
+	// stream isn't finished until either side sends MessageTypeClose.
+	MessageTypeCloseWrite
+
+	// MessageTypeError is sent by the relay when it refuses or gives up on the
+	// server. Code is one of the ErrorCode values and Reason is a human
+	// readable explanation. The relay closes the connection after sending it
+	// unless Listener is set, in which case only that MessageTypeListen was
+	// refused.
+	MessageTypeError
+
+	// MessageTypePing is sent by either side when CapabilityKeepAlive is used
+	// to check that the other side is still there. It should be answered with
+	// MessageTypePong.
+	MessageTypePing
+
+	// MessageTypePong is the answer to MessageTypePing.
+	MessageTypePong
+
+	// MessageTypeRegister is sent by the server right after the hellos when
+	// CapabilityRegister is used. Port is the port it would like clients to
+	// connect to or zero for any. Service names the server so the relay can
+	// give it the same port it had the last time it registered. If the port
+	// can't be used, the relay sends MessageTypeError unless Fallback is set,
+	// in which case it picks another one. With CapabilityTLS, TLS asks the
+	// relay to terminate TLS for clients, offering them the ALPN Protocols.
+	// With CapabilityVirtualHost, Host asks for the clients of the relay's
+	// shared port that want that hostname instead of a port. With
+	// CapabilityACL, clients whose address matches a Deny rule are refused
+	// and, if there are Allow rules, so are those that don't match one. With
+	// CapabilityRateLimit, ServerRate and ClientRate ask the relay to relay at
+	// most that many bytes per second each way for all of the server's
+	// clients and for each one.
+	MessageTypeRegister
+
+	// MessageTypeAck is sent by either side when CapabilityResume is used. Ack
+	// is how many stream messages (see Message.Replayable) the sender has
+	// received in the session so far. The other side doesn't need to keep them
+	// for resuming anymore.
+	MessageTypeAck
+
+	// MessageTypeShutdown is sent by the relay when CapabilityShutdown is used
+	// and it's shutting down. It stops taking new clients but the existing
+	// streams keep working until they finish or Timestamp, in unix seconds,
+	// passes. The relay then closes the connection. Reason says why.
+	MessageTypeShutdown
+
+	// MessageTypeListen is sent by the server when CapabilityListeners is
+	// used to open another public port. Listener is a new ID the server
+	// picks, larger than every one before it, and the other fields are the
+	// same as for MessageTypeRegister. The relay answers with
+	// MessageTypeRelay or MessageTypeError for the same Listener.
+	MessageTypeListen
+
+	// MessageTypeUnlisten is sent by the server to close the Listener it
+	// opened with MessageTypeListen. Streams that came through it keep
+	// working.
+	MessageTypeUnlisten
 )
 
 // Message is a generic message that the servers and clients use to communicate.
-// If the message is from or for a client, the remote and local addresses should
-// be filled.
+// If the message is from or for a client, the ID should be filled. Fields that
+// don't apply to a message's type are left empty.
 type Message struct {
-	Type       MessageType
-	RemoteAddr string
-	LocalAddr  string
-	Data       []byte
+	Type MessageType
+
+	// ID is the stream ID of the client the message is about. The relay assigns
+	// them starting at 1 and never reuses them on a control connection.
+	ID uint32 `json:",omitempty"`
+
+	// Listener is the public listener a message is about when
+	// CapabilityListeners is used. Zero is the one the server got in its
+	// first MessageTypeRelay.
+	Listener uint32 `json:",omitempty"`
+
+	RemoteAddr string `json:",omitempty"`
+	LocalAddr  string `json:",omitempty"`
+	ServerName string `json:",omitempty"`
+	Protocol   string `json:",omitempty"`
+	Data       []byte `json:",omitempty"`
+
+	// Compressed is set on MessageTypeData when the Data was compressed with
+	// DEFLATE. It's only used with CapabilityCompression.
+	Compressed bool `json:",omitempty"`
+
+	// Version and Capabilities are used by MessageTypeHello.
+	Version      int          `json:",omitempty"`
+	Capabilities Capabilities `json:",omitempty"`
+
+	// Token, or Identity, Timestamp, Nonce and Signature, are the credentials
+	// a server puts in its MessageTypeHello when the relay requires them.
+	// Token is a bearer token. Signature is made with Sign and Nonce makes
+	// each one different. MessageTypeShutdown also uses Timestamp.
+	Token     string `json:",omitempty"`
+	Identity  string `json:",omitempty"`
+	Timestamp int64  `json:",omitempty"`
+	Nonce     string `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
+
+	// Window is used by MessageTypeHello and MessageTypeWindow.
+	Window uint32 `json:",omitempty"`
+
+	// Code and Reason are used by MessageTypeError. MessageTypeShutdown also
+	// uses Reason.
+	Code   ErrorCode `json:",omitempty"`
+	Reason string    `json:",omitempty"`
+
+	// Port, Service, Fallback, TLS, Protocols, Host, Allow and Deny are used
+	// by MessageTypeRegister and MessageTypeListen.
+	Port      int      `json:",omitempty"`
+	Service   string   `json:",omitempty"`
+	Fallback  bool     `json:",omitempty"`
+	TLS       bool     `json:",omitempty"`
+	Protocols []string `json:",omitempty"`
+	Host      string   `json:",omitempty"`
+	Allow     []string `json:",omitempty"`
+	Deny      []string `json:",omitempty"`
+
+	// ServerRate and ClientRate are used by MessageTypeRegister.
+	ServerRate uint64 `json:",omitempty"`
+	ClientRate uint64 `json:",omitempty"`
+
+	// ResumeToken and Ack are used with CapabilityResume. The relay gives the
+	// server the token in MessageTypeRelay and the server puts it in its
+	// MessageTypeHello to resume the session. Ack is how many stream messages
+	// the sender has received in the session.
+	ResumeToken string `json:",omitempty"`
+	Ack         uint64 `json:",omitempty"`
+}
+
+const (
+	// MaxDataSize is the largest Data payload a single message may carry.
+	// Larger writes are split up into multiple messages.
+	MaxDataSize = 64 * 1024
+
+	// DefaultWindow is the flow control window used when none is given.
+	DefaultWindow = 256 * 1024
+)
+
+// Replayable returns true for the stream messages each side keeps until the
+// other acknowledges them when CapabilityResume is used. They are the ones
+// with an ID or a Listener.
+func (m *Message) Replayable() bool {
+	return m.ID != 0 || m.Listener != 0
 }
 
 // String returns a human readable version of this message.
@@ -69,6 +249,6 @@ func (m *Message) String() string {
 	if len(s) > 20 {
 		s = s[:20]
 	}
-	return fmt.Sprintf("[%v %v %v %v]",
-		m.Type, m.RemoteAddr, m.LocalAddr, s)
+	return fmt.Sprintf("[%v %v %v %v %v]",
+		m.Type, m.ID, m.RemoteAddr, m.LocalAddr, s)
 }
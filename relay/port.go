@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrListenersUnsupported is returned by Listener.Listen when the relay can't
+// open more ports on one control connection.
+var ErrListenersUnsupported = errors.New("relay doesn't support more listeners")
+
+// Endpoint describes a public port to open with Listener.Listen. The fields
+// mean the same as the Dialer's.
+type Endpoint struct {
+	Port         int
+	Service      string
+	Fallback     bool
+	Host         string
+	TerminateTLS bool
+	Protocols    []string
+	Allow        []string
+	Deny         []string
+}
+
+// Port is another public port on the relay opened with Listener.Listen. It
+// implements net.Listener for the clients connecting to it. It shares the
+// Listener's control connection and shuts down with it.
+type Port struct {
+	id uint32
+	l  *Listener
+	in chan net.Conn
+	// ready is closed once the relay answered. addr is the address it gave
+	// us or err why it refused.
+	ready chan struct{}
+	addr  string
+	err   error
+	// close is closed once the Port has been closed.
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+// portAddr is the address of a Port as the relay gave it to us.
+type portAddr string
+
+func (a portAddr) Network() string { return "tcp" }
+func (a portAddr) String() string  { return string(a) }
+
+// Listen asks the relay for another public port. Clients connecting to it are
+// returned by the Port's Accept instead of the Listener's. If the relay
+// refuses, an *Error is returned and the Listener carries on.
+func (l *Listener) Listen(e Endpoint) (*Port, error) {
+	if !l.caps.Has(CapabilityListeners) {
+		return nil, ErrListenersUnsupported
+	}
+	if e.TerminateTLS && !l.caps.Has(CapabilityTLS) {
+		return nil, ErrTLSUnsupported
+	}
+	if e.Host != "" && !l.caps.Has(CapabilityVirtualHost) {
+		return nil, ErrVirtualHostUnsupported
+	}
+	if (len(e.Allow) > 0 || len(e.Deny) > 0) && !l.caps.Has(CapabilityACL) {
+		return nil, ErrACLUnsupported
+	}
+	p := &Port{
+		l:     l,
+		in:    make(chan net.Conn, acceptBacklog),
+		ready: make(chan struct{}),
+		close: make(chan struct{}),
+	}
+	l.lock.Lock()
+	l.lastPort++
+	p.id = l.lastPort
+	l.ports[p.id] = p
+	l.lock.Unlock()
+	sent := l.send(&Message{
+		Type:      MessageTypeListen,
+		Listener:  p.id,
+		Port:      e.Port,
+		Service:   e.Service,
+		Fallback:  e.Fallback,
+		TLS:       e.TerminateTLS,
+		Protocols: e.Protocols,
+		Host:      e.Host,
+		Allow:     e.Allow,
+		Deny:      e.Deny,
+	})
+	if !sent {
+		return nil, l.err
+	}
+	select {
+	case <-p.ready:
+	case <-l.close:
+		return nil, l.err
+	}
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p, nil
+}
+
+// answer hands the relay's answer to the listen for the Port with the given
+// ID to it. err is set if the relay refused.
+func (l *Listener) answer(id uint32, addr string, err error) {
+	l.lock.Lock()
+	p := l.ports[id]
+	if err != nil {
+		delete(l.ports, id)
+	}
+	l.lock.Unlock()
+	if p == nil {
+		l.log.Warn("no port, answer ignored", "listener", id)
+		return
+	}
+	p.addr, p.err = addr, err
+	close(p.ready)
+}
+
+// Accept implements the net.Listener interface. It returns the clients that
+// connect to this port. Once the Port or its Listener is closed, it returns
+// the reason.
+func (p *Port) Accept() (net.Conn, error) {
+	select {
+	case <-p.l.close:
+		return nil, p.l.err
+	case <-p.close:
+		return nil, net.ErrClosed
+	case conn := <-p.in:
+		return conn, nil
+	}
+}
+
+// Close tells the relay to stop listening on the port. Connections already
+// accepted keep working and the ones waiting to be are closed.
+func (p *Port) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.close)
+		p.l.lock.Lock()
+		delete(p.l.ports, p.id)
+		p.l.lock.Unlock()
+		p.l.send(&Message{Type: MessageTypeUnlisten, Listener: p.id})
+		for {
+			select {
+			case conn := <-p.in:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Addr implements the net.Listener interface. It returns the address clients
+// use to connect to the port.
+func (p *Port) Addr() net.Addr {
+	return portAddr(p.addr)
+}
@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Replay keeps the stream messages sent in a resumable session until the other
+// side acknowledges them so they can be sent again after reconnecting. It's
+// safe for concurrent use. The zero value is ready to use.
+type Replay struct {
+	lock sync.Mutex
+	msgs []*Message
+	// sent is how many messages were added in total. msgs holds the last
+	// len(msgs) of them.
+	sent uint64
+	size int
+}
+
+// Add records msg as sent. Only messages with a stream ID should be added.
+func (r *Replay) Add(msg *Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.msgs = append(r.msgs, msg)
+	r.sent++
+	r.size += len(msg.Data)
+}
+
+// Ack forgets the first n messages sent.
+func (r *Replay) Ack(n uint64) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ack(n)
+}
+
+func (r *Replay) ack(n uint64) error {
+	if n > r.sent {
+		return fmt.Errorf("%w: %v messages acknowledged but only %v sent",
+			ErrUnexpectedMessage, n, r.sent)
+	}
+	first := r.sent - uint64(len(r.msgs))
+	if n <= first {
+		return nil
+	}
+	drop := int(n - first)
+	for _, m := range r.msgs[:drop] {
+		r.size -= len(m.Data)
+	}
+	clear(r.msgs[:drop])
+	r.msgs = r.msgs[drop:]
+	return nil
+}
+
+// Since acknowledges the first n messages and returns the ones sent after
+// them. It fails if some of those were already forgotten.
+func (r *Replay) Since(n uint64) ([]*Message, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if first := r.sent - uint64(len(r.msgs)); n < first {
+		return nil, fmt.Errorf("%w: %v messages received but %v were acknowledged",
+			ErrUnexpectedMessage, n, first)
+	}
+	if err := r.ack(n); err != nil {
+		return nil, err
+	}
+	return slices.Clone(r.msgs), nil
+}
+
+// Size returns how many bytes of data are being kept.
+func (r *Replay) Size() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.size
+}
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+)
+
+// addData adds n data messages of size bytes each to r, numbering their IDs
+// on from the ones already sent.
+func addData(r *Replay, n, size int) {
+	for i := 0; i < n; i++ {
+		r.Add(&Message{Type: MessageTypeData, ID: uint32(r.sent) + 1, Data: make([]byte, size)})
+	}
+}
+
+// checkIDs fails unless msgs have the given stream IDs in order.
+func checkIDs(t *testing.T, name string, msgs []*Message, ids ...uint32) {
+	t.Helper()
+	if len(msgs) != len(ids) {
+		t.Errorf("%v: got %v messages, want %v", name, len(msgs), len(ids))
+		return
+	}
+	for i, m := range msgs {
+		if m.ID != ids[i] {
+			t.Errorf("%v: message %v has id %v, want %v", name, i, m.ID, ids[i])
+		}
+	}
+}
+
+func TestReplayAck(t *testing.T) {
+	r := &Replay{}
+	addData(r, 5, 10)
+	if got := r.Size(); got != 50 {
+		t.Errorf("size before ack: got %v, want 50", got)
+	}
+	tests := []struct {
+		ack  uint64
+		size int
+	}{
+		{0, 50},
+		{2, 30},
+		// Acks may repeat or arrive late.
+		{2, 30},
+		{1, 30},
+		{5, 0},
+	}
+	for _, test := range tests {
+		if err := r.Ack(test.ack); err != nil {
+			t.Errorf("ack %v: %v", test.ack, err)
+		}
+		if got := r.Size(); got != test.size {
+			t.Errorf("ack %v: size is %v, want %v", test.ack, got, test.size)
+		}
+	}
+	if len(r.msgs) != 0 {
+		t.Errorf("kept %v messages after acking all of them", len(r.msgs))
+	}
+}
+
+func TestReplaySince(t *testing.T) {
+	r := &Replay{}
+	addData(r, 5, 1)
+	msgs, err := r.Since(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "since 0", msgs, 1, 2, 3, 4, 5)
+
+	// Since acknowledges what was received.
+	msgs, err = r.Since(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "since 3", msgs, 4, 5)
+	if got := r.Size(); got != 2 {
+		t.Errorf("size after since 3: got %v, want 2", got)
+	}
+
+	// What's returned doesn't change as more is sent or acknowledged.
+	addData(r, 1, 1)
+	if err := r.Ack(5); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "since 3 after more", msgs, 4, 5)
+
+	msgs, err = r.Since(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "since 6", msgs)
+}
+
+func TestReplayOverflow(t *testing.T) {
+	r := &Replay{}
+	addData(r, 4, 1)
+	if err := r.Ack(5); !errors.Is(err, ErrUnexpectedMessage) {
+		t.Errorf("acking more than sent: got %v, want %v", err, ErrUnexpectedMessage)
+	}
+	if _, err := r.Since(5); !errors.Is(err, ErrUnexpectedMessage) {
+		t.Errorf("since more than sent: got %v, want %v", err, ErrUnexpectedMessage)
+	}
+	if err := r.Ack(3); err != nil {
+		t.Fatal(err)
+	}
+	// The other side can't have received less than it acknowledged.
+	if _, err := r.Since(2); !errors.Is(err, ErrUnexpectedMessage) {
+		t.Errorf("since forgotten messages: got %v, want %v", err, ErrUnexpectedMessage)
+	}
+	// Failing doesn't lose anything.
+	msgs, err := r.Since(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIDs(t, "since 3", msgs, 4)
+}
+
+func TestReplayBuffer(t *testing.T) {
+	// The Listener stops taking messages once resumeBuffer bytes are kept and
+	// carries on once enough are acknowledged.
+	r := &Replay{}
+	addData(r, resumeBuffer/MaxDataSize, MaxDataSize)
+	if got := r.Size(); got < resumeBuffer {
+		t.Fatalf("size is %v, want at least %v", got, resumeBuffer)
+	}
+	addData(r, 1, 0)
+	if got := r.Size(); got != resumeBuffer {
+		t.Errorf("empty message changed size to %v", got)
+	}
+	if err := r.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Size(); got != resumeBuffer-MaxDataSize {
+		t.Errorf("size after ack: got %v, want %v", got, resumeBuffer-MaxDataSize)
+	}
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultResumeTimeout is how long the Listener tries to resume its
+	// session when the Dialer doesn't say.
+	DefaultResumeTimeout = time.Minute
+
+	// AckEvery is how many stream messages a side of a resumable session
+	// receives before acknowledging them and AckInterval how long it waits at
+	// most to acknowledge any. Acknowledging often keeps what the other side
+	// has to hold for replaying small, but not so often that the acks cost
+	// more than the data.
+	AckEvery    = 32
+	AckInterval = 250 * time.Millisecond
+
+	// resumeBuffer is how many bytes of data we keep for the relay while
+	// we're resuming before making writers wait.
+	resumeBuffer = 1024 * 1024
+
+	// resumeMinDelay and resumeMaxDelay bound how long we wait between
+	// attempts to resume.
+	resumeMinDelay = 250 * time.Millisecond
+	resumeMaxDelay = 5 * time.Second
+)
+
+// reconnect gets our session back after the connection to the relay broke
+// with cause. It keeps trying until the relay refuses us or the Dialer's
+// ResumeTimeout passes and returns the decoder for the new connection.
+func (l *Listener) reconnect(cause error) (Decoder, error) {
+	conn, _, _ := l.link()
+	conn.Close()
+	if l.stopping.Load() {
+		return nil, net.ErrClosed
+	}
+	l.log.Warn("lost the relay, resuming", "err", cause)
+	timeout := l.dialer.ResumeTimeout
+	if timeout == 0 {
+		timeout = DefaultResumeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	delay := resumeMinDelay
+	for {
+		select {
+		case <-l.close:
+			return nil, net.ErrClosed
+		default:
+		}
+		dec, err := l.resume(deadline)
+		if err == nil {
+			return dec, nil
+		}
+		var rerr *Error
+		if errors.As(err, &rerr) || time.Now().Add(delay).After(deadline) {
+			return nil, fmt.Errorf("resuming: %w", err)
+		}
+		l.log.Info("resuming failed, retrying", "err", err)
+		select {
+		case <-time.After(delay):
+		case <-l.close:
+			return nil, net.ErrClosed
+		}
+		delay = min(2*delay, resumeMaxDelay)
+	}
+}
+
+// resume makes a new connection to the relay and resumes our session on it.
+func (l *Listener) resume(deadline time.Time) (Decoder, error) {
+	conn, enc, dec, err := l.dialer.open(l.addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	ours := l.dialer.hello(l.window)
+	ours.ResumeToken, ours.Ack = l.token, l.received.Load()
+	if _, err := hello(enc, dec, ours); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	enc, dec = l.compress(enc, dec)
+	msg, err := readRelay(dec)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	l.linkLock.Lock()
+	l.conn, l.enc, l.dec, l.ack = conn, enc, dec, msg.Ack
+	l.linkLock.Unlock()
+	l.lastSeen.Store(time.Now().UnixNano())
+	// Let the writer know so it sends what the relay missed.
+	select {
+	case l.relinked <- struct{}{}:
+	default:
+	}
+	l.log.Info("resumed", "local", conn.LocalAddr().String())
+	return dec, nil
+}
@@ -0,0 +1,711 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// ErrSpec is returned by Validate and Checker.Check when a message breaks the
+// protocol specification.
+var ErrSpec = errors.New("protocol violation")
+
+// Direction is who sends a message.
+type Direction int
+
+const (
+	// FromRelay is a message sent by the relay to a server.
+	FromRelay Direction = 1 << iota
+
+	// FromServer is a message sent by a server to the relay.
+	FromServer
+
+	// FromEither is a message either side may send.
+	FromEither = FromRelay | FromServer
+)
+
+// String returns the string representation of the given direction.
+func (d Direction) String() string {
+	switch d {
+	case FromRelay:
+		return "relay"
+	case FromServer:
+		return "server"
+	case FromEither:
+		return "either"
+	}
+	return ""
+}
+
+// other returns the opposite direction.
+func (d Direction) other() Direction {
+	return FromEither &^ d
+}
+
+// FieldSpec describes a field of a message.
+type FieldSpec struct {
+	// Name is the Message field name, which is also its JSON name.
+	Name string
+
+	// Required fields must be set. Others may be left empty.
+	Required bool
+
+	// Capability, if set, must have been agreed to for the field to be set.
+	Capability string
+
+	Description string
+}
+
+// MessageSpec describes a message type. Fields not listed must be left empty.
+type MessageSpec struct {
+	Type MessageType
+	From Direction
+
+	// Capability, if set, must have been agreed to for the message to be sent.
+	Capability string
+
+	Fields      []FieldSpec
+	Description string
+}
+
+// Spec is the specification of every message type. Validate and Checker use
+// it to check messages and WriteSpec renders it as a document.
+var Spec = []MessageSpec{
+	{
+		Type: MessageTypeHello,
+		From: FromEither,
+		Fields: []FieldSpec{
+			{Name: "Version", Required: true, Description: "the protocol version the sender speaks (ProtocolVersion)"},
+			{Name: "Capabilities", Description: "the server's supported capabilities or the relay's agreed ones"},
+			{Name: "Window", Description: "the per stream flow control window of the sender; required with \"flow\""},
+			{Name: "Token", Description: "the server's bearer token"},
+			{Name: "Identity", Description: "who the server claims to be when signing"},
+			{Name: "Timestamp", Description: "when the signature was made in unix seconds"},
+			{Name: "Nonce", Description: "a random string that's different for every signature"},
+			{Name: "Signature", Description: "the server's signature"},
+			{Name: "ResumeToken", Description: "the token of the session the server is resuming"},
+			{Name: "Ack", Description: "how many stream messages the server received in the session it's resuming"},
+		},
+		Description: "The first message from each side after the codec preamble. The server sends it first.",
+	},
+	{
+		Type: MessageTypeRelay,
+		From: FromRelay,
+		Fields: []FieldSpec{
+			{Name: "Data", Required: true, Description: "the addr:port clients can connect to"},
+			{Name: "ResumeToken", Capability: CapabilityResume, Description: "the token the server can resume the session with"},
+			{Name: "Ack", Capability: CapabilityResume, Description: "how many stream messages the relay received in the session being resumed"},
+			{Name: "Listener", Capability: CapabilityListeners, Description: "the listen this answers"},
+		},
+		Description: "Sent once after the hellos. Clients may connect from then on. With a Listener, it answers a listen instead and Data is the address of the new port.",
+	},
+	{
+		Type: MessageTypeError,
+		From: FromRelay,
+		Fields: []FieldSpec{
+			{Name: "Code", Required: true, Description: "an ErrorCode"},
+			{Name: "Reason", Required: true, Description: "a human readable explanation"},
+			{Name: "Listener", Capability: CapabilityListeners, Description: "the listen being refused"},
+		},
+		Description: "The relay refuses or gives up on the server. It's the last message the relay sends unless it has a Listener, in which case only that listen was refused.",
+	},
+	{
+		Type:        MessageTypeStop,
+		From:        FromServer,
+		Description: "The server is done. It's the last message the server sends.",
+	},
+	{
+		Type: MessageTypeConnect,
+		From: FromRelay,
+		Fields: []FieldSpec{
+			{Name: "ID", Required: true, Description: "the new stream ID; larger than every previous one"},
+			{Name: "RemoteAddr", Required: true, Description: "the client's address"},
+			{Name: "LocalAddr", Required: true, Description: "the address the client connected to"},
+			{Name: "ServerName", Capability: CapabilityTLS, Description: "the server name the TLS client asked for"},
+			{Name: "Protocol", Capability: CapabilityTLS, Description: "the ALPN protocol negotiated with the TLS client"},
+			{Name: "Listener", Capability: CapabilityListeners, Description: "the listener the client connected to; zero for the first one"},
+		},
+		Description: "A client connected.",
+	},
+	{
+		Type: MessageTypeData,
+		From: FromEither,
+		Fields: []FieldSpec{
+			{Name: "ID", Required: true, Description: "the stream"},
+			{Name: "Data", Required: true, Description: "at most MaxDataSize bytes"},
+			{Name: "Compressed", Capability: CapabilityCompression, Description: "Data is DEFLATE compressed"},
+		},
+		Description: "Data for or from a client. Not allowed after the sender closed the stream or its write side.",
+	},
+	{
+		Type: MessageTypeClose,
+		From: FromEither,
+		Fields: []FieldSpec{
+			{Name: "ID", Required: true, Description: "the stream"},
+		},
+		Description: "The stream is finished. The sender sends nothing more for it.",
+	},
+	{
+		Type:       MessageTypeWindow,
+		From:       FromEither,
+		Capability: CapabilityFlowControl,
+		Fields: []FieldSpec{
+			{Name: "ID", Required: true, Description: "the stream"},
+			{Name: "Window", Required: true, Description: "how many more bytes the receiver may send"},
+		},
+		Description: "The sender consumed data and has room for more. A side may never have more unacknowledged data on a stream than the window the other side advertised in its hello.",
+	},
+	{
+		Type:       MessageTypeCloseWrite,
+		From:       FromEither,
+		Capability: CapabilityHalfClose,
+		Fields: []FieldSpec{
+			{Name: "ID", Required: true, Description: "the stream"},
+		},
+		Description: "The sender won't send more data on the stream but will still receive.",
+	},
+	{
+		Type:       MessageTypeRegister,
+		From:       FromServer,
+		Capability: CapabilityRegister,
+		Fields: []FieldSpec{
+			{Name: "Port", Description: "the port the server wants; zero for any"},
+			{Name: "Service", Description: "the server's name; without a Port, the relay tries the port the service last had"},
+			{Name: "Fallback", Description: "pick another port instead of refusing when Port can't be used"},
+			{Name: "TLS", Capability: CapabilityTLS, Description: "the relay should terminate TLS for clients"},
+			{Name: "Protocols", Capability: CapabilityTLS, Description: "the ALPN protocols to offer TLS clients"},
+			{Name: "Host", Capability: CapabilityVirtualHost, Description: "the hostname, or *.domain wildcard, to get the shared port's clients for instead of a port"},
+			{Name: "Allow", Capability: CapabilityACL, Description: "the CIDR prefixes or addresses clients must come from"},
+			{Name: "Deny", Capability: CapabilityACL, Description: "the CIDR prefixes or addresses clients are refused from"},
+			{Name: "ServerRate", Capability: CapabilityRateLimit, Description: "the most bytes per second to relay each way for all of the server's clients; zero for the relay's limit"},
+			{Name: "ClientRate", Capability: CapabilityRateLimit, Description: "the most bytes per second to relay each way for each client; zero for the relay's limit"},
+		},
+		Description: "Sent once right after the hellos. The relay replies with relay or, if the port can't be used, an error.",
+	},
+	{
+		Type:        MessageTypePing,
+		From:        FromEither,
+		Capability:  CapabilityKeepAlive,
+		Description: "Checks the other side is alive. It must answer with a pong.",
+	},
+	{
+		Type:        MessageTypePong,
+		From:        FromEither,
+		Capability:  CapabilityKeepAlive,
+		Description: "The answer to a ping.",
+	},
+	{
+		Type:       MessageTypeAck,
+		From:       FromEither,
+		Capability: CapabilityResume,
+		Fields: []FieldSpec{
+			{Name: "Ack", Required: true, Description: "how many stream messages the sender received in the session"},
+		},
+		Description: "The sender received the stream messages up to Ack. The other side no longer needs to keep them for resuming.",
+	},
+	{
+		Type:       MessageTypeShutdown,
+		From:       FromRelay,
+		Capability: CapabilityShutdown,
+		Fields: []FieldSpec{
+			{Name: "Timestamp", Required: true, Description: "when the relay closes the streams that are left in unix seconds"},
+			{Name: "Reason", Description: "a human readable explanation"},
+		},
+		Description: "The relay is shutting down. It stops taking new clients but existing streams keep working until they finish or Timestamp passes. Then the relay closes the connection.",
+	},
+	{
+		Type:       MessageTypeListen,
+		From:       FromServer,
+		Capability: CapabilityListeners,
+		Fields: []FieldSpec{
+			{Name: "Listener", Required: true, Description: "the new listener's ID; larger than every previous one"},
+			{Name: "Port", Description: "the port the server wants; zero for any"},
+			{Name: "Service", Description: "the listener's name; without a Port, the relay tries the port the service last had"},
+			{Name: "Fallback", Description: "pick another port instead of refusing when Port can't be used"},
+			{Name: "TLS", Capability: CapabilityTLS, Description: "the relay should terminate TLS for clients"},
+			{Name: "Protocols", Capability: CapabilityTLS, Description: "the ALPN protocols to offer TLS clients"},
+			{Name: "Host", Capability: CapabilityVirtualHost, Description: "the hostname, or *.domain wildcard, to get the shared port's clients for instead of a port"},
+			{Name: "Allow", Capability: CapabilityACL, Description: "the CIDR prefixes or addresses clients must come from"},
+			{Name: "Deny", Capability: CapabilityACL, Description: "the CIDR prefixes or addresses clients are refused from"},
+		},
+		Description: "Opens another public port after the relay message. The relay answers with relay or error for the same Listener. Clients connecting to it come with its Listener in connect.",
+	},
+	{
+		Type:       MessageTypeUnlisten,
+		From:       FromServer,
+		Capability: CapabilityListeners,
+		Fields: []FieldSpec{
+			{Name: "Listener", Required: true, Description: "a listener opened with listen"},
+		},
+		Description: "Closes the port of a listener. Streams that came through it keep working. Connects for it that were already on their way may still arrive.",
+	},
+}
+
+// specFor returns the spec for the given type or nil if there isn't one.
+func specFor(t MessageType) *MessageSpec {
+	for i := range Spec {
+		if Spec[i].Type == t {
+			return &Spec[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks that msg may be sent from the given direction when the
+// given capabilities were agreed to and that its fields match the spec. Data
+// is checked as it was sent, before any decompression.
+func Validate(msg *Message, from Direction, caps Capabilities) error {
+	spec := specFor(msg.Type)
+	if spec == nil {
+		return fmt.Errorf("%w: unknown message type %d", ErrSpec, int(msg.Type))
+	}
+	if spec.From&from == 0 {
+		return fmt.Errorf("%w: %v may not be sent by the %v", ErrSpec, msg.Type, from)
+	}
+	if spec.Capability != "" && !caps.Has(spec.Capability) {
+		return fmt.Errorf("%w: %v requires %q", ErrSpec, msg.Type, spec.Capability)
+	}
+	v := reflect.ValueOf(msg).Elem()
+	allowed := map[string]bool{"Type": true}
+	for _, f := range spec.Fields {
+		allowed[f.Name] = true
+		set := !v.FieldByName(f.Name).IsZero()
+		if f.Required && !set {
+			return fmt.Errorf("%w: %v requires %v", ErrSpec, msg.Type, f.Name)
+		}
+		if set && f.Capability != "" && !caps.Has(f.Capability) {
+			return fmt.Errorf("%w: %v.%v requires %q", ErrSpec, msg.Type, f.Name, f.Capability)
+		}
+	}
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if !allowed[name] && !v.Field(i).IsZero() {
+			return fmt.Errorf("%w: %v doesn't allow %v", ErrSpec, msg.Type, name)
+		}
+	}
+	if len(msg.Data) > MaxDataSize {
+		return fmt.Errorf("%w: %v bytes of data is more than %v", ErrSpec, len(msg.Data), MaxDataSize)
+	}
+	return nil
+}
+
+// streamState is what the Checker knows about a stream. Each array is indexed
+// by the sender.
+type streamState struct {
+	closed      [2]bool
+	writeClosed [2]bool
+	credit      [2]int
+	// resumed is set for streams from before the session was resumed. We
+	// don't know their credit.
+	resumed bool
+}
+
+// listenerState is what the Checker knows about a listener the server opened
+// with listen.
+type listenerState struct {
+	// answered is set once the relay answered the listen and open if it did
+	// so with relay. closed is set once the server sent unlisten.
+	answered bool
+	open     bool
+	closed   bool
+	// resumed is set for listeners from before the session was resumed. We
+	// don't know what happened to them.
+	resumed bool
+}
+
+// Checker checks the messages of a single control connection against the
+// ordering rules of the protocol as well as Validate. Messages should be given
+// to it in the order each side sent them. The zero value is ready to use.
+type Checker struct {
+	hello      [2]*Message
+	caps       Capabilities
+	relayed    bool
+	registered bool
+	// resumed is set when the server resumed a session. Its streams started
+	// on an earlier connection.
+	resumed bool
+	// done is set once a side sent its last message. The other side may still
+	// send what it sent before hearing about it.
+	done    [2]bool
+	lastID  uint32
+	streams map[uint32]*streamState
+	// lastListener is the last listener the server opened.
+	lastListener uint32
+	listeners    map[uint32]*listenerState
+}
+
+// index returns the array index used for the given direction.
+func index(d Direction) int {
+	if d == FromRelay {
+		return 0
+	}
+	return 1
+}
+
+// Capabilities returns the capabilities agreed to in the hellos.
+func (c *Checker) Capabilities() Capabilities {
+	return c.caps
+}
+
+// Check checks that msg may be sent from the given direction at this point in
+// the conversation.
+func (c *Checker) Check(msg *Message, from Direction) error {
+	me, them := index(from), index(from.other())
+	if c.done[me] {
+		return fmt.Errorf("%w: %v after the %v ended the conversation", ErrSpec, msg.Type, from)
+	}
+	if err := Validate(msg, from, c.caps); err != nil {
+		return err
+	}
+	// The hellos come first and the server says hello first.
+	if c.hello[me] == nil {
+		// The relay refuses servers that don't start with a hello.
+		if msg.Type == MessageTypeError && from == FromRelay {
+			c.done[me] = true
+			return nil
+		}
+		if msg.Type != MessageTypeHello {
+			return fmt.Errorf("%w: %v before hello", ErrSpec, msg.Type)
+		}
+		if from == FromRelay && c.hello[them] == nil {
+			return fmt.Errorf("%w: relay said hello first", ErrSpec)
+		}
+		if from == FromServer {
+			c.resumed = msg.ResumeToken != ""
+		}
+		if from == FromRelay {
+			server := c.hello[them]
+			for _, name := range msg.Capabilities {
+				if !server.Capabilities.Has(name) {
+					return fmt.Errorf("%w: relay agreed to %q which the server didn't offer", ErrSpec, name)
+				}
+			}
+			c.caps = msg.Capabilities
+			if c.caps.Has(CapabilityFlowControl) && (msg.Window == 0 || server.Window == 0) {
+				return fmt.Errorf("%w: flow control without a window", ErrSpec)
+			}
+			if msg.Version != server.Version {
+				// The relay closes the connection after a mismatch.
+				c.done[me] = true
+			}
+		}
+		c.hello[me] = msg
+		return nil
+	}
+	if msg.Type == MessageTypeHello {
+		return fmt.Errorf("%w: more than one hello", ErrSpec)
+	}
+	if c.hello[them] == nil {
+		return fmt.Errorf("%w: %v before the relay's hello", ErrSpec, msg.Type)
+	}
+	switch msg.Type {
+	case MessageTypeError:
+		if msg.Listener != 0 {
+			return c.answer(msg)
+		}
+		c.done[me] = true
+		return nil
+	case MessageTypeStop:
+		c.done[me] = true
+		return nil
+	case MessageTypePing, MessageTypePong, MessageTypeAck, MessageTypeShutdown:
+		return nil
+	case MessageTypeRegister:
+		if c.registered {
+			return fmt.Errorf("%w: more than one register", ErrSpec)
+		}
+		if c.resumed {
+			return fmt.Errorf("%w: register when resuming", ErrSpec)
+		}
+		c.registered = true
+		return nil
+	case MessageTypeRelay:
+		if msg.Listener != 0 {
+			return c.answer(msg)
+		}
+		if c.relayed {
+			return fmt.Errorf("%w: more than one relay", ErrSpec)
+		}
+		if c.caps.Has(CapabilityRegister) && !c.registered && !c.resumed {
+			return fmt.Errorf("%w: relay before register", ErrSpec)
+		}
+		c.relayed = true
+		return nil
+	}
+	if !c.relayed {
+		return fmt.Errorf("%w: %v before relay", ErrSpec, msg.Type)
+	}
+	switch msg.Type {
+	case MessageTypeListen:
+		if msg.Listener <= c.lastListener {
+			return fmt.Errorf("%w: listener %v reused or out of order", ErrSpec, msg.Listener)
+		}
+		c.lastListener = msg.Listener
+		if c.listeners == nil {
+			c.listeners = make(map[uint32]*listenerState)
+		}
+		c.listeners[msg.Listener] = &listenerState{}
+		return nil
+	case MessageTypeUnlisten:
+		l := c.listener(msg.Listener)
+		if l == nil {
+			return fmt.Errorf("%w: unlisten for unknown listener %v", ErrSpec, msg.Listener)
+		}
+		if l.closed {
+			return fmt.Errorf("%w: listener %v closed twice", ErrSpec, msg.Listener)
+		}
+		l.closed = true
+		return nil
+	}
+	if msg.Type == MessageTypeConnect {
+		if msg.Listener != 0 {
+			l := c.listener(msg.Listener)
+			if l == nil || (!l.open && !l.resumed) {
+				return fmt.Errorf("%w: connect for listener %v that isn't open", ErrSpec, msg.Listener)
+			}
+		}
+		if msg.ID <= c.lastID {
+			return fmt.Errorf("%w: stream %v reused or out of order", ErrSpec, msg.ID)
+		}
+		c.lastID = msg.ID
+		if c.streams == nil {
+			c.streams = make(map[uint32]*streamState)
+		}
+		s := &streamState{}
+		s.credit[index(FromRelay)] = int(c.hello[index(FromServer)].Window)
+		s.credit[index(FromServer)] = int(c.hello[index(FromRelay)].Window)
+		c.streams[msg.ID] = s
+		return nil
+	}
+	// Everything else is about a stream.
+	s := c.streams[msg.ID]
+	if s == nil && c.resumed {
+		// It must have started before the session was resumed.
+		if c.streams == nil {
+			c.streams = make(map[uint32]*streamState)
+		}
+		s = &streamState{resumed: true}
+		c.streams[msg.ID] = s
+	}
+	if s == nil {
+		return fmt.Errorf("%w: %v for unknown stream %v", ErrSpec, msg.Type, msg.ID)
+	}
+	if s.closed[me] {
+		return fmt.Errorf("%w: %v after closing stream %v", ErrSpec, msg.Type, msg.ID)
+	}
+	switch msg.Type {
+	case MessageTypeData:
+		if s.writeClosed[me] {
+			return fmt.Errorf("%w: data after closing the write side of stream %v", ErrSpec, msg.ID)
+		}
+		if c.caps.Has(CapabilityFlowControl) && !msg.Compressed && !s.resumed {
+			s.credit[me] -= len(msg.Data)
+			if s.credit[me] < 0 {
+				return fmt.Errorf("%w: stream %v overran its window by %v bytes", ErrSpec, msg.ID, -s.credit[me])
+			}
+		}
+	case MessageTypeWindow:
+		s.credit[them] += int(msg.Window)
+	case MessageTypeCloseWrite:
+		if s.writeClosed[me] {
+			return fmt.Errorf("%w: closed the write side of stream %v twice", ErrSpec, msg.ID)
+		}
+		s.writeClosed[me] = true
+	case MessageTypeClose:
+		s.closed[me] = true
+	}
+	return nil
+}
+
+// listener returns what we know about the listener with the given ID or nil
+// if the server never opened it. Listeners from before the session was resumed
+// are taken on trust.
+func (c *Checker) listener(id uint32) *listenerState {
+	l := c.listeners[id]
+	if l == nil && c.resumed {
+		if c.listeners == nil {
+			c.listeners = make(map[uint32]*listenerState)
+		}
+		l = &listenerState{resumed: true}
+		c.listeners[id] = l
+	}
+	return l
+}
+
+// answer checks the relay's answer to a listen.
+func (c *Checker) answer(msg *Message) error {
+	if !c.relayed {
+		return fmt.Errorf("%w: %v for listener %v before relay", ErrSpec, msg.Type, msg.Listener)
+	}
+	l := c.listener(msg.Listener)
+	if l == nil {
+		return fmt.Errorf("%w: %v for listener %v the server didn't ask for", ErrSpec, msg.Type, msg.Listener)
+	}
+	if l.answered && !l.resumed {
+		return fmt.Errorf("%w: listener %v answered twice", ErrSpec, msg.Listener)
+	}
+	l.answered = true
+	l.open = msg.Type == MessageTypeRelay
+	return nil
+}
+
+// WriteSpec writes the specification as a markdown document.
+func WriteSpec(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString(specIntro)
+	for _, spec := range Spec {
+		fmt.Fprintf(&b, "\n### %v (%d)\n\n", spec.Type, int(spec.Type))
+		fmt.Fprintf(&b, "Sent by: %v\n\n", spec.From)
+		if spec.Capability != "" {
+			fmt.Fprintf(&b, "Requires: `%v`\n\n", spec.Capability)
+		}
+		b.WriteString(spec.Description + "\n")
+		if len(spec.Fields) > 0 {
+			b.WriteString("\n| Field | Required | Description |\n|---|---|---|\n")
+		}
+		for _, f := range spec.Fields {
+			req := "no"
+			if f.Required {
+				req = "yes"
+			}
+			desc := f.Description
+			if f.Capability != "" {
+				desc += fmt.Sprintf(" (requires `%v`)", f.Capability)
+			}
+			fmt.Fprintf(&b, "| %v | %v | %v |\n", f.Name, req, desc)
+		}
+	}
+	b.WriteString("\n## Error codes\n\n| Code | Name |\n|---|---|\n")
+	for code := ErrorCodeNoPorts; code.String() != fmt.Sprintf("code %d", int(code)); code++ {
+		fmt.Fprintf(&b, "| %d | %v |\n", int(code), code)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+const specIntro = `# tcprelay protocol
+
+This document is generated from the relay package (relay.WriteSpec). The
+conformance command checks implementations against the same specification.
+
+## Connection
+
+A server connects to the relay over TCP and sends the name of the codec it
+wants to use followed by a newline: ` + "`json\\n` or `binary\\n`" + `. Every
+message after that uses the codec in both directions.
+
+The conversation goes:
+
+1. The server sends a hello with its protocol version and capabilities.
+2. The relay replies with a hello with its protocol version and the
+   capabilities both sides will use. If the versions differ, the relay closes
+   the connection.
+3. If both agreed to ` + "`register`" + `, the server sends a register
+   message asking for a port.
+4. The relay sends a relay message with the address clients connect to or an
+   error message if it refuses the server.
+5. Streams come and go: the relay sends connect when a client connects and
+   either side sends data, close and the other stream messages. With
+   ` + "`listeners`" + `, the server may open more ports at any time.
+6. The server sends stop when it's done or the relay sends an error when it
+   gives up on the server. A relay that's shutting down sends shutdown, lets
+   the streams finish for a while and then closes the connection.
+
+Fields that don't apply to a message type must be left empty.
+
+## Codecs
+
+The ` + "`json`" + ` codec sends each message as a JSON object using the
+field names below. ` + "`Type`" + ` is the number of the message type and
+` + "`Data`" + ` is base64 encoded.
+
+The ` + "`binary`" + ` codec sends each message as a frame:
+
+| Field | Size |
+|---|---|
+| type | 1 byte |
+| flags | 1 byte; bit 0 is Compressed |
+| stream id | uvarint |
+| data | uvarint length followed by that many bytes |
+| extension | uvarint length followed by that many bytes |
+
+Uvarints are unsigned LEB128 varints as written by Go's
+encoding/binary.PutUvarint. The extension holds a JSON object with the fields
+that aren't in the frame header. It's empty for data messages. Data is never
+more than MaxDataSize (65536) bytes.
+
+## Capabilities
+
+Optional features are only used when the server offers them in its hello and
+the relay agrees to them in its own.
+
+- ` + "`flow`" + `: each side's hello carries its per stream window. A side may
+  only send as much data on a stream as the other side has room for. The
+  receiver hands the room back with window messages as it consumes data.
+- ` + "`halfclose`" + `: a side can stop sending on a stream with close write
+  while still receiving. The stream only ends with close.
+- ` + "`keepalive`" + `: either side may send pings and the other answers
+  with pongs. A side that doesn't hear anything for a while may hang up.
+- ` + "`deflate`" + `: data may be sent compressed with raw DEFLATE (RFC 1951),
+  one complete stream per message. Window accounting uses the uncompressed
+  size.
+- ` + "`register`" + `: the server asks for the port or service it wants
+  before the relay picks one so its clients can find it at the same address
+  after a restart.
+- ` + "`tls`" + `: the relay can terminate TLS for the server's clients.
+- ` + "`resume`" + `: a server that loses its connection can get its port and
+  streams back. See below.
+- ` + "`shutdown`" + `: the relay warns the server with a shutdown message
+  before it goes away and lets the existing streams finish.
+- ` + "`listeners`" + `: the server can open and close more public ports on
+  the same connection with listen and unlisten. Each one is identified by the
+  Listener the server picked and connect says which one a client came
+  through. Stream IDs are shared by all of them so the other stream messages
+  don't need to say.
+- ` + "`vhost`" + `: the relay has a shared public port. A server can register
+  a ` + "`Host`" + ` instead of a port and gets the clients whose TLS SNI or
+  HTTP Host header asks for it. What the relay read to find out is part of
+  the stream so the server sees the whole request.
+- ` + "`acl`" + `: the relay refuses clients by address. A server can add
+  ` + "`Allow`" + ` and ` + "`Deny`" + ` rules, CIDR prefixes or single
+  addresses, for its ports. A client matching a deny rule is refused and, if
+  there are allow rules, so is one that doesn't match any. The relay's own
+  rules still apply. Refused clients are closed without a connect.
+- ` + "`ratelimit`" + `: the relay limits how many bytes per second it relays
+  each way, for each client, for each server and overall. A server can ask
+  for a lower ` + "`ServerRate`" + ` and ` + "`ClientRate`" + ` when it
+  registers but never a higher one than the relay allows. The relay slows
+  down reading from and writing to clients to keep to them.
+
+## Authentication
+
+A relay may require servers to authenticate. Each server is given an identity
+and a secret. It either sends the secret in its hello as ` + "`Token`" + ` or
+sets ` + "`Identity`" + `, ` + "`Timestamp`" + ` (unix seconds), a random
+` + "`Nonce`" + ` and ` + "`Signature`" + `: the HMAC-SHA256, keyed by the
+secret, of ` + "`tcprelay\\n<identity>\\n<timestamp>\\n<nonce>`" + `. The
+timestamp must be within five minutes of the relay's clock and each nonce can
+only be used once per identity. A relay that doesn't accept the credentials
+sends an error with the auth code instead of its hello.
+
+## Resuming
+
+With ` + "`resume`" + `, the relay's relay message carries a
+` + "`ResumeToken`" + `. When the control connection is lost, the relay keeps
+the server's ports and clients for a grace period. The server reconnects and
+sends a hello with the same capabilities and window, its credentials, the
+` + "`ResumeToken`" + ` and, in ` + "`Ack`" + `, how many stream messages
+(the ones with an ID or a Listener) it received in the session. It doesn't
+register again. The relay answers with its hello and a relay message whose ` + "`Ack`" + ` is
+how many stream messages it received, or an error with the resume code if the
+session is gone.
+
+Each side then sends again every stream message after the ones the other side
+received, in the original order, and carries on. To know what to keep, each
+side acknowledges what it received with ack messages every so often. The
+counts cover the whole session, not just one connection.
+
+## Messages
+`
@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// ErrPinMismatch is returned by Dial when the relay's certificate doesn't
+// match any of the Dialer's pins.
+var ErrPinMismatch = errors.New("relay certificate doesn't match any pin")
+
+// Pin returns the pin of a certificate: the SHA-256 hash of its public key
+// info. The relay logs the pin of its certificate when it starts.
+func Pin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// tlsClient starts TLS on the connection to the relay at addr.
+func (d *Dialer) tlsClient(conn net.Conn, addr string) (net.Conn, error) {
+	var cfg *tls.Config
+	if d.TLSConfig != nil {
+		cfg = d.TLSConfig.Clone()
+	} else {
+		// The pins are all we have to go on.
+		cfg = &tls.Config{InsecureSkipVerify: true}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if len(d.Pins) > 0 {
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			pin := Pin(cs.PeerCertificates[0])
+			for _, p := range d.Pins {
+				if bytes.Equal(p, pin) {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	c := tls.Client(conn, cfg)
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+var (
+	// sessions are the servers that can be resumed by their token.
+	sessions    = map[string]*server{}
+	sessionLock = sync.Mutex{}
+
+	// ErrSessionGone is returned by attach when the session stopped waiting
+	// for the server to resume.
+	ErrSessionGone = errors.New("session is gone")
+)
+
+// link is a control connection to a server. A server that resumes its session
+// gets a new one.
+type link struct {
+	conn net.Conn
+	enc  relay.Encoder
+	dec  relay.Decoder
+	// ack is how many stream messages the server said it had received when it
+	// resumed on this link.
+	ack uint64
+}
+
+// newResumeToken returns a random token for resuming a session.
+func newResumeToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// rememberSession makes s resumable by its token.
+func rememberSession(s *server) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	sessions[s.token] = s
+}
+
+// forgetSession makes s no longer resumable.
+func forgetSession(s *server) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+	delete(sessions, s.token)
+}
+
+// currentLink returns the control connection in use.
+func (s *server) currentLink() *link {
+	s.linkCond.L.Lock()
+	defer s.linkCond.L.Unlock()
+	return s.link
+}
+
+// detach is called when the control connection l broke. If the server can
+// resume, it waits for it to do so and returns the new link. Otherwise, or if
+// the server doesn't come back within resumeGrace, it returns nil.
+func (s *server) detach(l *link) *link {
+	l.conn.Close()
+	if !s.caps.Has(relay.CapabilityResume) || isClosed(s.close) {
+		return nil
+	}
+	s.log.Info("waiting for the server to resume", "grace", resumeGrace)
+	// Send new clients of its services to the servers that are still here.
+	s.pauseMembers(true)
+	defer s.pauseMembers(false)
+	t := time.AfterFunc(resumeGrace, func() {
+		s.linkCond.L.Lock()
+		if s.link == l {
+			s.expired = true
+		}
+		s.linkCond.L.Unlock()
+		s.linkCond.Broadcast()
+	})
+	defer t.Stop()
+	s.linkCond.L.Lock()
+	defer s.linkCond.L.Unlock()
+	s.parked = true
+	s.linkCond.Broadcast()
+	for s.link == l && !s.expired {
+		s.linkCond.Wait()
+	}
+	s.parked = false
+	if s.link == l {
+		if !isClosed(s.close) {
+			s.log.Warn("server didn't resume in time")
+		}
+		return nil
+	}
+	return s.link
+}
+
+// attach hands the session over to the new control connection l. If the old
+// one isn't known to be broken yet, it's closed first.
+func (s *server) attach(l *link) error {
+	s.linkCond.L.Lock()
+	defer s.linkCond.L.Unlock()
+	s.link.conn.Close()
+	for !s.parked && !s.expired {
+		s.linkCond.Wait()
+	}
+	if s.expired {
+		return ErrSessionGone
+	}
+	// The reader is waiting so nobody else is receiving. Tell the server how
+	// much of what it sent got here before anything else goes out.
+	err := l.enc.Encode(&relay.Message{
+		Type:        relay.MessageTypeRelay,
+		Data:        []byte(s.primary.addr),
+		ResumeToken: s.token,
+		Ack:         s.received.Load(),
+	})
+	if err != nil {
+		return err
+	}
+	s.lastSeen.Store(time.Now().UnixNano())
+	s.link = l
+	s.linkCond.Broadcast()
+	select {
+	case s.relinked <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// resume gives the session the server's hello asks for to this connection. s
+// is only used for the handshake and is thrown away afterwards.
+func (s *server) resume(hello *relay.Message) {
+	sessionLock.Lock()
+	old := sessions[hello.ResumeToken]
+	sessionLock.Unlock()
+	// Only the server that started the session may resume it and it has to
+	// keep using what was agreed to.
+	switch {
+	case !s.caps.Has(relay.CapabilityResume):
+		s.refuse(relay.ErrorCodeResume, "resuming isn't supported")
+		return
+	case old == nil || old.identity != s.identity:
+		s.refuse(relay.ErrorCodeResume, "no session to resume")
+		return
+	case !slices.Equal(old.caps, s.caps) || old.peerWindow != s.peerWindow:
+		s.refuse(relay.ErrorCodeProtocol, "the session was started with different capabilities")
+		return
+	}
+	err := old.attach(&link{conn: s.conn, enc: s.enc, dec: s.dec, ack: hello.Ack})
+	if err == ErrSessionGone {
+		s.refuse(relay.ErrorCodeResume, "no session to resume")
+		return
+	}
+	if err != nil {
+		old.log.Warn("resuming failed", "from", s.conn.RemoteAddr().String(), "err", err)
+		s.conn.Close()
+		return
+	}
+	old.log.Info("resumed", "from", s.conn.RemoteAddr().String())
+}
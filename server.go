@@ -1,94 +1,384 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/icub3d/tcprelay/relay"
 )
 
+// capabilities are the optional protocol features this relay supports.
+var capabilities = relay.Capabilities{
+	relay.CapabilityFlowControl,
+	relay.CapabilityHalfClose,
+	relay.CapabilityKeepAlive,
+	relay.CapabilityCompression,
+	relay.CapabilityRegister,
+	relay.CapabilityShutdown,
+	relay.CapabilityListeners,
+	relay.CapabilityACL,
+	relay.CapabilityRateLimit,
+}
+
+// handshakeTimeout is how long a server has from connecting to being
+// registered.
+const handshakeTimeout = 10 * time.Second
+
 // Server contains the information about a connecting server. It should be
 // created with the newServer function.
 type server struct {
-	port     int
-	conn     net.Conn
-	listener net.Listener
-	clients  map[string]*client
-	lock     sync.Mutex
-	toServer chan *relay.Message
-	close    chan struct{}
-	wg       sync.WaitGroup
+	conn net.Conn
+	enc  relay.Encoder
+	dec  relay.Decoder
+	caps relay.Capabilities
+	// peerWindow is how many bytes the server will buffer for each client.
+	peerWindow uint32
+	// primary is the public listener the server registered for. It's also
+	// the first of listeners, which holds every one the server has open by
+	// ID. lastListener is the last ID the server used.
+	primary      *publicListener
+	listeners    map[uint32]*publicListener
+	lastListener uint32
+	clients      map[uint32]*client
+	lastID       uint32
+	lock         sync.Mutex
+	toServer     chan *relay.Message
+	close        chan struct{}
+	wg           sync.WaitGroup
+	// queued is how many messages are waiting to go on toServer.
+	queued atomic.Int64
+	// lastSeen is when we last heard from the server in unix nanoseconds.
+	lastSeen atomic.Int64
+	// identity is who the server authenticated as, if it had to.
+	identity string
+	// fromLimit and toLimit limit the bytes relayed each way for all of the
+	// server's clients. clientRate is the limit for each one. They're set
+	// when the server registers.
+	fromLimit  *limiter
+	toLimit    *limiter
+	clientRate uint64
+	// log carries the server's address, identity and, once we're relaying for
+	// it, ID and port.
+	log *slog.Logger
+	// id identifies the server in logs and the admin API. started is set
+	// once we're relaying for it.
+	id      uint64
+	started time.Time
+	// token lets the server resume its session after losing the control
+	// connection. replay holds the stream messages it hasn't acknowledged and
+	// received counts the ones it sent us.
+	token    string
+	replay   relay.Replay
+	received atomic.Uint64
+	// linkCond guards link, the control connection in use, as well as parked,
+	// which is set while handleMessagesFromServer waits for the server to
+	// resume, and expired, which is set once we stop waiting. relinked tells
+	// handleMessagesToServer about a new link and ackNow that it's time to
+	// acknowledge what we received.
+	linkCond *sync.Cond
+	link     *link
+	parked   bool
+	expired  bool
+	relinked chan struct{}
+	ackNow   chan struct{}
+	// closeOnce makes sure we only close once. draining is set, under lock,
+	// when the relay is shutting down and drained is closed once the
+	// clients are all gone after that. notified is closed once the
+	// shutdown message was written to the server.
+	closeOnce sync.Once
+	draining  bool
+	drained   chan struct{}
+	notified  chan struct{}
 }
 
 // newServer sets up a new server connection. It will communicate with the
 // server what port it's publishing and then forward any tcp traffic.
 func newServer(conn net.Conn) {
 	var err error
+	id := lastServer.Add(1)
 	s := &server{
-		conn:     conn,
-		clients:  make(map[string]*client),
-		toServer: make(chan *relay.Message),
-		close:    make(chan struct{}),
-	}
-	// Find an unused port.
-	s.port = findUnusedPort()
-	if s.port == -1 {
-		// We didn't find one, notify the server and exit!
-		log.Println("didn't find an open port for server:", conn.RemoteAddr())
+		id:        id,
+		conn:      conn,
+		listeners: make(map[uint32]*publicListener),
+		clients:   make(map[uint32]*client),
+		toServer:  make(chan *relay.Message),
+		close:     make(chan struct{}),
+		linkCond:  sync.NewCond(&sync.Mutex{}),
+		relinked:  make(chan struct{}, 1),
+		ackNow:    make(chan struct{}, 1),
+		drained:   make(chan struct{}),
+		notified:  make(chan struct{}),
+		log:       slog.With("server", id, "remote", conn.RemoteAddr().String()),
+	}
+	// With TLS, a client certificate tells us who the server is.
+	if tc, ok := conn.(*tls.Conn); ok {
+		tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tc.Handshake(); err != nil {
+			s.log.Warn("TLS handshake failed", "err", err)
+			conn.Close()
+			return
+		}
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			s.identity = certIdentity(certs[0])
+			s.log = s.log.With("identity", s.identity)
+			s.log.Info("authenticated by certificate")
+		}
+	}
+	// Don't wait forever on a server that doesn't get through the handshake.
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	// The server tells us which codec it wants to use first.
+	r := bufio.NewReader(conn)
+	codec, err := relay.ReadCodec(r)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// Servers from before codecs wait for us without sending one. They
+		// speak JSON.
+		s.enc = relay.JSONCodec.NewEncoder(conn)
+		s.refuseTimeout()
+		return
+	}
+	if err != nil {
+		s.log.Warn("reading codec", "err", err)
+		conn.Close()
+		return
+	}
+	s.enc = codec.NewEncoder(conn)
+	s.dec = codec.NewDecoder(r)
+	// Agree on the protocol.
+	hello, err := s.handshake()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		s.refuseTimeout()
+		return
+	}
+	if err != nil {
+		s.log.Warn("handshake failed", "err", err)
+		conn.Close()
+		return
+	}
+	// A server that lost its connection picks up where it left off.
+	if hello.ResumeToken != "" {
+		conn.SetDeadline(time.Time{})
+		s.resume(hello)
 		return
 	}
-	addr := fmt.Sprintf("%v:%v", saddr, s.port)
-	// create the listener for clients for this server.
-	s.listener, err = net.Listen("tcp", addr)
+	// Find the port the server wants or any unused one and listen on it.
+	p, err := s.register()
 	if err != nil {
-		log.Printf("unable to listen for %v: %v", conn.RemoteAddr(), err)
+		var rerr *relay.Error
+		if errors.As(err, &rerr) {
+			s.refuse(rerr.Code, rerr.Reason)
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.refuseTimeout()
+		} else {
+			s.log.Warn("registering", "err", err)
+			conn.Close()
+		}
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.primary = p
+	s.listeners[p.id] = p
+	s.link = &link{conn: s.conn, enc: s.enc, dec: s.dec}
+	s.log = s.log.With("port", p.portLabel())
+	if !rememberServer(s) {
+		p.close()
+		s.refuse(relay.ErrorCodeShutdown, "relay is shutting down")
 		return
 	}
+	if p.host != "" {
+		s.log.Info("host registered", "host", p.host, "addr", p.addr)
+	} else if p.service != "" {
+		s.log.Info("service registered", "service", p.service, "addr", p.addr)
+	} else {
+		s.log.Info("registered", "addr", p.addr)
+	}
 	// Start up the server goroutines.
-	go s.handleMessagesFromServer()
+	if s.caps.Has(relay.CapabilityResume) {
+		s.token = newResumeToken()
+		rememberSession(s)
+	}
+	s.lastSeen.Store(time.Now().UnixNano())
+	s.wg.Add(1)
 	go s.handleMessagesToServer()
+	go s.handleMessagesFromServer()
+	if s.caps.Has(relay.CapabilityKeepAlive) && keepAlive > 0 {
+		s.wg.Add(1)
+		go s.keepAlive()
+	}
 	// Send the relay relay.
 	msg := &relay.Message{
-		Type: relay.MessageTypeRelay,
-		Data: []byte(addr),
+		Type:        relay.MessageTypeRelay,
+		Data:        []byte(p.addr),
+		ResumeToken: s.token,
 	}
 	if !s.Send(msg) {
 		return
 	}
 	// Start listeneing for clients.
-	go s.listen()
+	s.wg.Add(1)
+	go s.listen(p)
 }
 
-// String returns the RemoteAddr for this server.
+// handshake reads the hello from the server and replies with our own. It fails
+// if the server didn't start with a hello or speaks a different version.
+// Otherwise it returns the server's hello.
+func (s *server) handshake() (*relay.Message, error) {
+	msg := &relay.Message{}
+	if err := s.dec.Decode(msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != relay.MessageTypeHello {
+		err := fmt.Errorf("%w: %v instead of hello", relay.ErrUnexpectedMessage, msg.Type)
+		s.enc.Encode(&relay.Message{
+			Type:   relay.MessageTypeError,
+			Code:   relay.ErrorCodeProtocol,
+			Reason: err.Error(),
+		})
+		return nil, err
+	}
+	if t := tokens.Load(); t != nil && s.identity == "" {
+		identity, err := t.authenticate(msg)
+		if err != nil {
+			s.enc.Encode(&relay.Message{
+				Type:   relay.MessageTypeError,
+				Code:   relay.ErrorCodeAuth,
+				Reason: ErrUnauthenticated.Error(),
+			})
+			return nil, err
+		}
+		s.identity = identity
+		s.log = s.log.With("identity", identity)
+		s.log.Info("authenticated")
+	}
+	// Always reply so the server can see which version we speak.
+	s.caps = capabilities.Negotiate(msg.Capabilities)
+	s.peerWindow = msg.Window
+	err := s.enc.Encode(&relay.Message{
+		Type:         relay.MessageTypeHello,
+		Version:      relay.ProtocolVersion,
+		Capabilities: s.caps,
+		Window:       window,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if msg.Version != relay.ProtocolVersion {
+		return nil, fmt.Errorf("%w: server speaks version %v, we speak %v",
+			relay.ErrVersionMismatch, msg.Version, relay.ProtocolVersion)
+	}
+	if s.caps.Has(relay.CapabilityFlowControl) && s.peerWindow == 0 {
+		return nil, fmt.Errorf("%w: flow control without a window", relay.ErrUnexpectedMessage)
+	}
+	if s.caps.Has(relay.CapabilityCompression) {
+		s.enc, s.dec = relay.NewCompression(s.enc, s.dec, compress)
+	}
+	return msg, nil
+}
+
+// register opens the public listener for the server. If the server registers,
+// the port it asked for is used when possible and TLS is set up if it wants
+// it. A *relay.Error is returned when the server should be refused.
+func (s *server) register() (*publicListener, error) {
+	msg := &relay.Message{}
+	if s.caps.Has(relay.CapabilityRegister) {
+		if err := s.dec.Decode(msg); err != nil {
+			return nil, err
+		}
+		if msg.Type != relay.MessageTypeRegister {
+			return nil, &relay.Error{
+				Code:   relay.ErrorCodeProtocol,
+				Reason: fmt.Sprintf("%v instead of register", msg.Type),
+			}
+		}
+	}
+	s.setLimits(msg)
+	return s.openListener(0, msg)
+}
+
+// refuse tells the server why we won't relay for it and closes the connection.
+// It's only used before the server goroutines are started.
+func (s *server) refuse(code relay.ErrorCode, reason string) {
+	s.log.Warn("refusing server", "code", code, "reason", reason)
+	err := s.enc.Encode(&relay.Message{
+		Type:   relay.MessageTypeError,
+		Code:   code,
+		Reason: reason,
+	})
+	if err != nil {
+		s.log.Warn("sending error", "err", err)
+	}
+	s.conn.Close()
+}
+
+// refuseTimeout tells the server it took too long to get through the
+// handshake and closes the connection.
+func (s *server) refuseTimeout() {
+	// The deadline has passed so give the error a moment to be written.
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.refuse(relay.ErrorCodeTimeout, "handshake took too long")
+}
+
+// String returns the RemoteAddr for this server along with who it
+// authenticated as.
 func (s *server) String() string {
+	if s.identity != "" {
+		return fmt.Sprintf("%v@%v", s.identity, s.conn.RemoteAddr())
+	}
 	return s.conn.RemoteAddr().String()
 }
 
 // Close closes all the open connections and waits for all the goroutines to
-// finish. It then release the port being used by this server.
+// finish. It also releases the port being used by this server. It's safe to
+// call more than once.
 func (s *server) Close() {
-	// Close the server connection and client listener.
+	s.closeOnce.Do(s.closeAll)
+}
+
+func (s *server) closeAll() {
+	forgetServer(s)
+	if !s.started.IsZero() {
+		serverDurations.observe(time.Since(s.started).Seconds())
+	}
+	// Close the client listeners and the server connection. The ports can be
+	// handed out again as soon as nobody is listening on them so a restarting
+	// server can get them back.
 	close(s.close)
-	s.listener.Close()
-	// Close all of the clients.
-	s.lock.Lock()
-	for _, c := range s.clients {
+	if s.token != "" {
+		forgetSession(s)
+	}
+	for _, p := range s.publicListeners() {
+		p.close()
+	}
+	s.linkCond.L.Lock()
+	s.expired = true
+	s.link.conn.Close()
+	s.linkCond.L.Unlock()
+	s.linkCond.Broadcast()
+	// Close all of the clients. They remove themselves from the table so we
+	// can't hold the lock while closing them.
+	for _, c := range s.allClients() {
 		if err := c.Close(); err != nil {
-			log.Printf("[%v] closing %v: %v", s, c, err)
+			c.log.Debug("closing client", "err", err)
 		}
 	}
-	s.lock.Unlock()
-	// Wait for our goroutines to finish and then release the port.
+	// Wait for our goroutines to finish.
 	s.wg.Wait()
-	releasePort(s.port)
 }
 
 // Send sends the given relay to the server. It returns true if successful. If
 // the server was closed while trying to send, false is returned.
 func (s *server) Send(msg *relay.Message) bool {
+	s.queued.Add(1)
+	defer s.queued.Add(-1)
 	select {
 	case s.toServer <- msg:
 		return true
@@ -97,115 +387,314 @@ func (s *server) Send(msg *relay.Message) bool {
 	}
 }
 
+// keepAlive pings the server every keepAlive and closes the connection to it
+// if we haven't heard anything within keepAliveTimeout. That in turn closes
+// the server unless it can resume.
+func (s *server) keepAlive() {
+	defer s.wg.Done()
+	t := time.NewTicker(keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.close:
+			return
+		case <-t.C:
+		}
+		last := time.Unix(0, s.lastSeen.Load())
+		if time.Since(last) > keepAliveTimeout {
+			s.log.Warn("nothing heard from the server, giving up", "last_seen", last)
+			s.currentLink().conn.Close()
+			continue
+		}
+		s.Send(&relay.Message{Type: relay.MessageTypePing})
+	}
+}
+
 // handleMessagesFromServer reads messages from the server and handles them
-// appropriately.
+// appropriately. It isn't part of the WaitGroup as it's the one that closes the
+// server once the connection is done and the server didn't resume.
 func (s *server) handleMessagesFromServer() {
-	// TODO the WaitGroup is sort of funky here with the Close() we can probably
-	// tighten this up a bit.
-	s.wg.Add(1)
-	dec := json.NewDecoder(s.conn)
+	resume := s.caps.Has(relay.CapabilityResume)
+	l := s.currentLink()
 	for {
 		// Get a relay.
 		msg := &relay.Message{}
-		err := dec.Decode(msg)
+		err := l.dec.Decode(msg)
 		if err != nil {
-			log.Printf("[%v] decoding relay : %v", s, err)
-			s.wg.Done()
-			s.Close()
-			return
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				decodeErrors.Add(1)
+			}
+			s.log.Info("control connection lost", "err", err)
+			if l = s.detach(l); l == nil {
+				s.Close()
+				return
+			}
+			continue
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		if resume && msg.Replayable() {
+			// Acknowledge in batches. The writer also does it every so often.
+			if s.received.Add(1)%relay.AckEvery == 0 {
+				select {
+				case s.ackNow <- struct{}{}:
+				default:
+				}
+			}
 		}
 		// Do something based on the relay.
 		switch msg.Type {
 		case relay.MessageTypeStop:
-			s.wg.Done()
 			s.Close()
 			return
+		case relay.MessageTypePing:
+			s.Send(&relay.Message{Type: relay.MessageTypePong})
+		case relay.MessageTypePong:
+			// Hearing from the server is all we wanted.
+		case relay.MessageTypeListen:
+			s.listenMore(msg)
+		case relay.MessageTypeUnlisten:
+			s.unlisten(msg.Listener)
+		case relay.MessageTypeAck:
+			if err := s.replay.Ack(msg.Ack); err != nil {
+				s.log.Warn("bad acknowledgement", "err", err)
+				s.Close()
+				return
+			}
 		case relay.MessageTypeData:
-			c := s.getClient(msg.RemoteAddr)
+			c := s.getClient(msg.ID)
 			if c == nil {
-				log.Printf("[%v] data not sent - no client: %v", s, msg.RemoteAddr)
+				s.log.Debug("data not sent - no client", "stream", msg.ID)
 				continue
 			}
-			if err := c.Send(msg.Data); err != nil {
-				log.Printf("[%v] sending to %v: %v", s, c, err)
+			c.Send(msg.Data)
+		case relay.MessageTypeWindow:
+			c := s.getClient(msg.ID)
+			if c == nil {
+				// The client probably closed while the update was in flight.
+				continue
 			}
+			c.Grant(msg.Window)
 		case relay.MessageTypeClose:
-			c := s.getClient(msg.RemoteAddr)
+			c := s.getClient(msg.ID)
 			if c == nil {
-				log.Printf("[%v] unabel to close - no client: %v", s, msg.RemoteAddr)
+				s.log.Debug("unable to close - no client", "stream", msg.ID)
 				continue
 			}
-			if err := c.Close(); err != nil {
-				log.Printf("[%v] closing %v: %v", s, c, err)
+			// Let anything the server sent before closing reach the client.
+			c.Finish()
+		case relay.MessageTypeCloseWrite:
+			c := s.getClient(msg.ID)
+			if c == nil {
+				s.log.Debug("unable to close write - no client", "stream", msg.ID)
+				continue
 			}
+			c.FinishWrite()
 		default:
-			log.Printf("[%v] unexpected relay: %v", s, msg)
+			s.log.Warn("unexpected message", "type", msg.Type)
 		}
 	}
 }
 
 // handleMessagesToServer loops reading from the channel for messages that
 // should be sent to the server. It sends those messages over the connection.
+// While the server is resuming, it keeps the stream messages to send later.
 func (s *server) handleMessagesToServer() {
-	s.wg.Add(1)
 	defer s.wg.Done()
+	resume := s.caps.Has(relay.CapabilityResume)
+	l := s.currentLink()
+	// up is false once sending failed until the server resumes. acked is what
+	// we last told the server we received.
+	up := true
+	var acked uint64
+	var acks <-chan time.Time
+	if resume {
+		t := time.NewTicker(relay.AckInterval)
+		defer t.Stop()
+		acks = t.C
+	}
+	send := func(msg *relay.Message) {
+		if !up {
+			return
+		}
+		if err := l.enc.Encode(msg); err != nil {
+			// Closing the connection makes the reader close the server or
+			// wait for it to resume.
+			s.log.Info("sending to the server failed", "err", err)
+			l.conn.Close()
+			up = false
+		}
+	}
 	for {
-		// Get the next relay or exit.
+		// Get the next relay or exit. Without a connection, we only take as
+		// many as we're willing to keep.
+		msgs := s.toServer
+		if !up && s.replay.Size() >= resumeBuffer {
+			msgs = nil
+		}
 		var msg *relay.Message
 		var ok bool
 		select {
-		case msg, ok = <-s.toServer:
+		case msg, ok = <-msgs:
 			if !ok {
 				return
 			}
+		case <-s.relinked:
+			// Send whatever the server missed on the new connection.
+			l, up, acked = s.currentLink(), true, 0
+			missed, err := s.replay.Since(l.ack)
+			if err != nil {
+				s.log.Warn("resuming failed", "err", err)
+				l.conn.Close()
+				up = false
+			}
+			for _, m := range missed {
+				send(m)
+			}
+			continue
+		case <-acks:
+		case <-s.ackNow:
 		case <-s.close:
 			return
 		}
-		// Send the relay.
-		d, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("[%v] marshalling relay: %v", s, err)
+		if msg == nil {
+			if n := s.received.Load(); n > acked {
+				send(&relay.Message{Type: relay.MessageTypeAck, Ack: n})
+				acked = n
+			}
 			continue
 		}
-		_, err = s.conn.Write(d)
-		if err != nil {
-			log.Printf("[%v] sending relay : %v", s, err)
-			break
+		// Send the relay.
+		if resume && msg.Replayable() {
+			s.replay.Add(msg)
+		}
+		send(msg)
+		if msg.Type == relay.MessageTypeShutdown {
+			close(s.notified)
 		}
 	}
 }
 
-// getClient returns the client mapped to the given remote address.
-func (s *server) getClient(addr string) *client {
+// getClient returns the client mapped to the given stream ID.
+func (s *server) getClient(id uint32) *client {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	return s.clients[addr]
+	return s.clients[id]
 }
 
-// listen loops Accept()ing for client connections. When it gets
-// one, it creates a new client struct and adds it to our client table.
-func (s *server) listen() {
-	s.wg.Add(1)
+// allClients returns the clients in our table.
+func (s *server) allClients() []*client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// removeClient removes the client with the given stream ID from our table.
+func (s *server) removeClient(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.clients, id)
+	if s.draining && len(s.clients) == 0 && !isClosed(s.drained) {
+		close(s.drained)
+	}
+}
+
+// addClient assigns the next stream ID to a new client for conn, which came
+// through the given listener, and adds it to our client table. It returns nil
+// if the server was closed or is draining.
+func (s *server) addClient(conn net.Conn, listener uint32) *client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.draining || isClosed(s.close) {
+		return nil
+	}
+	s.lastID++
+	c := newClient(s.lastID, conn, s, listener)
+	s.clients[c.id] = c
+	return c
+}
+
+// listen loops Accept()ing for client connections on p. When it gets one, it
+// creates a new client struct and adds it to our client table.
+func (s *server) listen(p *publicListener) {
 	defer s.wg.Done()
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := p.listener.Accept()
 		if err != nil {
-			log.Printf("[%v] accepting: %v", s, err)
+			// We close the listener when closing or draining.
+			if !errors.Is(err, net.ErrClosed) {
+				s.log.Error("accepting clients", "listener", p.id, "err", err)
+			}
 			break
 		}
-		// Send the new connection relay.
-		msg := &relay.Message{
-			Type:       relay.MessageTypeConnect,
-			RemoteAddr: conn.RemoteAddr().String(),
-			LocalAddr:  conn.LocalAddr().String(),
+		if !p.admits(conn.RemoteAddr()) {
+			s.log.Info("client refused by address", "listener", p.id, "client", conn.RemoteAddr().String())
+			rejectedClients.Add(1)
+			conn.Close()
+			continue
+		}
+		// Don't let a slow TLS client hold up the others.
+		if p.tlsConfig != nil {
+			s.wg.Add(1)
+			go s.terminate(p, conn)
+			continue
 		}
-		if !s.Send(msg) {
+		if !s.connect(p, conn, "", "") {
 			break
 		}
-		// Setup the new client and add it to our table.
-		c := newClient(conn, s)
-		s.lock.Lock()
-		s.clients[conn.RemoteAddr().String()] = c
-		s.lock.Unlock()
 	}
 }
+
+// terminate does the TLS handshake with a client of p and then connects it.
+func (s *server) terminate(p *publicListener, conn net.Conn) {
+	defer s.wg.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	tc := tls.Server(conn, p.tlsConfig)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		s.log.Info("TLS handshake with client failed", "client", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	state := tc.ConnectionState()
+	s.connect(p, tc, state.ServerName, state.NegotiatedProtocol)
+}
+
+// connect adds a client for conn, which came through p, and tells the server
+// about it. It returns false if the server is gone.
+func (s *server) connect(p *publicListener, conn net.Conn, serverName, protocol string) bool {
+	// Setup the new client and add it to our table before telling the server
+	// so any replies find it.
+	c := s.addClient(conn, p.id)
+	if c == nil {
+		conn.Close()
+		return false
+	}
+	msg := &relay.Message{
+		Type:       relay.MessageTypeConnect,
+		ID:         c.id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		LocalAddr:  conn.LocalAddr().String(),
+		ServerName: serverName,
+		Protocol:   protocol,
+		Listener:   p.id,
+	}
+	if !s.Send(msg) {
+		s.removeClient(c.id)
+		conn.Close()
+		return false
+	}
+	// Only start reading once the server knows about the client.
+	c.start()
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// fromClient returns what the client sends the server next or nil if it sends
+// nothing within wait.
+func fromClient(s *server, wait time.Duration) *relay.Message {
+	select {
+	case msg := <-s.toServer:
+		return msg
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// dataFromClient returns the next n bytes of data the client sends the server.
+func dataFromClient(t *testing.T, s *server, n int) string {
+	t.Helper()
+	got := ""
+	for len(got) < n {
+		msg := fromClient(s, time.Second)
+		if msg == nil || msg.Type != relay.MessageTypeData {
+			t.Fatalf("got %v after %q, want data", msg, got)
+		}
+		got += string(msg.Data)
+	}
+	return got
+}
+
+func TestClientStopsWithoutCredit(t *testing.T) {
+	s, c, conn := testClient(t, relay.Capabilities{relay.CapabilityFlowControl}, 10)
+	written := make(chan struct{})
+	go func() {
+		conn.Write([]byte("0123456789abcdefghij"))
+		close(written)
+	}()
+
+	// Only the window's worth is read from the client.
+	if got := dataFromClient(t, s, 10); got != "0123456789" {
+		t.Errorf("got %q with 10 bytes of credit", got)
+	}
+	if msg := fromClient(s, 100*time.Millisecond); msg != nil {
+		t.Fatalf("got %v %q without credit", msg.Type, msg.Data)
+	}
+	select {
+	case <-written:
+		t.Fatal("client was read from without credit")
+	default:
+	}
+
+	// A window update lets it carry on.
+	c.Grant(10)
+	if got := dataFromClient(t, s, 10); got != "abcdefghij" {
+		t.Errorf("got %q after the window update", got)
+	}
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("client's write never finished")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+var (
+	// servers are the servers we're relaying for. Once shuttingDown is set,
+	// no more are added.
+	servers      = map[*server]bool{}
+	shuttingDown bool
+	serverLock   = sync.Mutex{}
+
+	// lastServer is the last ID given to a server.
+	lastServer atomic.Uint64
+)
+
+// rememberServer adds s to the servers we're relaying for. It returns false if
+// we're shutting down.
+func rememberServer(s *server) bool {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	if shuttingDown {
+		return false
+	}
+	s.started = time.Now()
+	servers[s] = true
+	return true
+}
+
+// forgetServer removes s from the servers we're relaying for.
+func forgetServer(s *server) {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	delete(servers, s)
+}
+
+// allServers returns the servers we're relaying for.
+func allServers() []*server {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	all := make([]*server, 0, len(servers))
+	for s := range servers {
+		all = append(all, s)
+	}
+	return all
+}
+
+// findServer returns the server with the given ID or nil if we aren't relaying
+// for it.
+func findServer(id uint64) *server {
+	serverLock.Lock()
+	defer serverLock.Unlock()
+	for s := range servers {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// drainServers drains every server in parallel and returns once they're all
+// closed. Clients still connected after timeout are cut off.
+func drainServers(timeout time.Duration) {
+	serverLock.Lock()
+	shuttingDown = true
+	all := make([]*server, 0, len(servers))
+	for s := range servers {
+		all = append(all, s)
+	}
+	serverLock.Unlock()
+	slog.Info("draining servers", "servers", len(all), "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+	var wg sync.WaitGroup
+	for _, s := range all {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.drain(deadline)
+		}()
+	}
+	wg.Wait()
+}
+
+// drain stops accepting clients for the server, tells it we're shutting down
+// and closes it once its clients are gone or the deadline passes.
+func (s *server) drain(deadline time.Time) {
+	s.lock.Lock()
+	s.draining = true
+	n := len(s.clients)
+	if n == 0 {
+		close(s.drained)
+	}
+	s.lock.Unlock()
+	// No listener can be added once we're draining.
+	for _, p := range s.publicListeners() {
+		p.listener.Close()
+	}
+	// Don't wait on a server that isn't reading. If it can't hear about the
+	// shutdown, there's nothing to wait for.
+	if s.caps.Has(relay.CapabilityShutdown) {
+		go s.Send(&relay.Message{
+			Type:      relay.MessageTypeShutdown,
+			Timestamp: deadline.Unix(),
+			Reason:    "relay is shutting down",
+		})
+	} else {
+		close(s.notified)
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-s.drained:
+		// Make sure the server heard why we're going away.
+		select {
+		case <-s.notified:
+		case <-s.close:
+		case <-t.C:
+		}
+	case <-s.close:
+		// It went away by itself.
+		return
+	case <-t.C:
+		s.lock.Lock()
+		n = len(s.clients)
+		s.lock.Unlock()
+		s.log.Warn("cutting off clients", "clients", n)
+	}
+	s.Close()
+}
+
+// isClosed returns true if c is closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// tlsHandshakeTimeout is how long a server has to finish the TLS handshake on
+// the control connection and a client on a server's port.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// publicCert is the certificate used to terminate TLS for servers that don't
+// have their own in publicCertDir.
+var publicCert *tls.Certificate
+
+// controlTLSConfig loads the certificate for the control listener. If clientCA
+// is given, servers must present a certificate signed by it.
+func controlTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + clientCA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Servers that pin our certificate need to know its pin.
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		slog.Info("certificate pin", "pin", base64.StdEncoding.EncodeToString(relay.Pin(leaf)))
+	}
+	return cfg, nil
+}
+
+// certIdentity returns the identity of a server that authenticated with the
+// given certificate. It's the common name or, failing that, the first DNS
+// name.
+func certIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.SerialNumber.String()
+}
+
+// publicTLSConfig returns the config used to terminate TLS for a server's
+// clients. The certificate is the first of name.pem and name.key found in
+// publicCertDir for the given names or else publicCert.
+func publicTLSConfig(names ...string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var tried []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		tried = append(tried, strconv.Quote(name))
+		// Names come from servers so don't let them wander out of the
+		// directory.
+		if publicCertDir == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+			continue
+		}
+		certFile := filepath.Join(publicCertDir, name+".pem")
+		if _, err := os.Stat(certFile); err != nil {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, filepath.Join(publicCertDir, name+".key"))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+		return cfg, nil
+	}
+	if publicCert == nil {
+		if len(tried) == 0 {
+			return nil, errors.New("no certificate for unnamed servers")
+		}
+		return nil, fmt.Errorf("no certificate for %v", strings.Join(tried, " or "))
+	}
+	cfg.Certificates = []tls.Certificate{*publicCert}
+	return cfg, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// ErrUnauthenticated is returned by authenticate when a server's credentials
+// are missing or wrong.
+var ErrUnauthenticated = errors.New("authentication failed")
+
+// tokenStore holds the identities and secrets servers authenticate with. The
+// secret can be sent as a bearer token or used to sign the hello.
+type tokenStore struct {
+	secrets map[string][]byte
+	// lock guards seen, the identities and nonces of the signatures used
+	// recently so a captured hello can't be replayed. Entries are dropped
+	// once they're too old to matter.
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// loadTokens reads a token file. Each line is an identity and its secret
+// separated by whitespace. Blank lines and lines starting with # are ignored.
+func loadTokens(path string) (*tokenStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &tokenStore{
+		secrets: make(map[string][]byte),
+		seen:    make(map[string]time.Time),
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%v:%v: expected an identity and a secret", path, n)
+		}
+		if _, ok := t.secrets[fields[0]]; ok {
+			return nil, fmt.Errorf("%v:%v: duplicate identity %q", path, n, fields[0])
+		}
+		t.secrets[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// buildTokens returns the credentials from the token file at path, if any,
+// and identities. It returns nil if there are none so servers don't need to
+// authenticate.
+func buildTokens(path string, identities map[string]string) (*tokenStore, error) {
+	if path == "" && len(identities) == 0 {
+		return nil, nil
+	}
+	t := &tokenStore{
+		secrets: make(map[string][]byte),
+		seen:    make(map[string]time.Time),
+	}
+	if path != "" {
+		var err error
+		if t, err = loadTokens(path); err != nil {
+			return nil, err
+		}
+	}
+	for identity, secret := range identities {
+		if _, ok := t.secrets[identity]; ok {
+			return nil, fmt.Errorf("identity %q is also in %v", identity, path)
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("identity %q has no secret", identity)
+		}
+		t.secrets[identity] = []byte(secret)
+	}
+	return t, nil
+}
+
+// keepSeen carries the nonces old has seen over to t so reloading doesn't
+// let them be replayed.
+func (t *tokenStore) keepSeen(old *tokenStore) {
+	if old == nil {
+		return
+	}
+	old.lock.Lock()
+	defer old.lock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, at := range old.seen {
+		t.seen[key] = at
+	}
+}
+
+// authenticate checks the credentials in a server's hello and returns the
+// identity they belong to.
+func (t *tokenStore) authenticate(msg *relay.Message) (string, error) {
+	switch {
+	case msg.Token != "":
+		// Check every secret so the time taken doesn't give anything away.
+		identity := ""
+		for id, secret := range t.secrets {
+			if subtle.ConstantTimeCompare([]byte(msg.Token), secret) == 1 {
+				identity = id
+			}
+		}
+		if identity == "" {
+			return "", fmt.Errorf("%w: unknown token", ErrUnauthenticated)
+		}
+		return identity, nil
+	case msg.Identity != "":
+		secret, ok := t.secrets[msg.Identity]
+		if !ok {
+			return "", fmt.Errorf("%w: unknown identity %q", ErrUnauthenticated, msg.Identity)
+		}
+		if msg.Nonce == "" {
+			return "", fmt.Errorf("%w: no nonce for %q", ErrUnauthenticated, msg.Identity)
+		}
+		if !relay.VerifySignature(msg, secret) {
+			return "", fmt.Errorf("%w: bad signature for %q", ErrUnauthenticated, msg.Identity)
+		}
+		now := time.Now()
+		signed := time.Unix(msg.Timestamp, 0)
+		if d := now.Sub(signed).Abs(); d > relay.SignatureMaxAge {
+			return "", fmt.Errorf("%w: signature for %q is %v off", ErrUnauthenticated, msg.Identity, d)
+		}
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		for key, at := range t.seen {
+			if now.Sub(at) > 2*relay.SignatureMaxAge {
+				delete(t.seen, key)
+			}
+		}
+		key := msg.Identity + "\n" + msg.Nonce
+		if _, ok := t.seen[key]; ok {
+			return "", fmt.Errorf("%w: replayed signature for %q", ErrUnauthenticated, msg.Identity)
+		}
+		t.seen[key] = now
+		return msg.Identity, nil
+	}
+	return "", fmt.Errorf("%w: no credentials", ErrUnauthenticated)
+}
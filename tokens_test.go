@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/icub3d/tcprelay/relay"
+)
+
+// signedHello returns a hello signed by identity with secret at timestamp.
+func signedHello(identity, secret string, timestamp int64) *relay.Message {
+	msg := &relay.Message{
+		Type:      relay.MessageTypeHello,
+		Identity:  identity,
+		Timestamp: timestamp,
+		Nonce:     relay.NewNonce(),
+	}
+	msg.Signature = relay.Sign(identity, []byte(secret), timestamp, msg.Nonce)
+	return msg
+}
+
+func TestAuthenticateSameSecond(t *testing.T) {
+	tokens, err := buildTokens("", map[string]string{"pool": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Servers of a pool share an identity and may well say hello in the same
+	// second.
+	now := time.Now().Unix()
+	first, second := signedHello("pool", "secret", now), signedHello("pool", "secret", now)
+	for _, msg := range []*relay.Message{first, second} {
+		if identity, err := tokens.authenticate(msg); err != nil || identity != "pool" {
+			t.Errorf("authenticating %v: got %q, %v", msg.Nonce, identity, err)
+		}
+	}
+	// Each hello still only works once.
+	if _, err := tokens.authenticate(first); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("replayed hello: got %v, want %v", err, ErrUnauthenticated)
+	}
+}
+
+func TestAuthenticateRejects(t *testing.T) {
+	tokens, err := buildTokens("", map[string]string{"server": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	noNonce := signedHello("server", "secret", now)
+	noNonce.Nonce = ""
+	noNonce.Signature = relay.Sign("server", []byte("secret"), now, "")
+	changedNonce := signedHello("server", "secret", now)
+	changedNonce.Nonce = relay.NewNonce()
+	tests := []struct {
+		name string
+		msg  *relay.Message
+	}{
+		{"no credentials", &relay.Message{Type: relay.MessageTypeHello}},
+		{"bad token", &relay.Message{Type: relay.MessageTypeHello, Token: "nope"}},
+		{"unknown identity", signedHello("other", "secret", now)},
+		{"wrong secret", signedHello("server", "nope", now)},
+		{"no nonce", noNonce},
+		{"changed nonce", changedNonce},
+		{"old", signedHello("server", "secret", now-int64(2*relay.SignatureMaxAge/time.Second))},
+	}
+	for _, test := range tests {
+		if _, err := tokens.authenticate(test.msg); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("%v: got %v, want %v", test.name, err, ErrUnauthenticated)
+		}
+	}
+	if identity, err := tokens.authenticate(&relay.Message{Token: "secret"}); err != nil || identity != "server" {
+		t.Errorf("token: got %q, %v", identity, err)
+	}
+}
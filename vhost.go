@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// peekTimeout is how long a client of the shared port has to say which
+	// host it wants.
+	peekTimeout = 10 * time.Second
+
+	// maxPeek is how much we read from a client of the shared port looking
+	// for the host it wants.
+	maxPeek = 16 * 1024
+)
+
+var (
+	// hosts are the host listeners by the hostname they were registered for.
+	hosts    = map[string]*hostListener{}
+	hostLock = sync.Mutex{}
+
+	// ErrHostInUse is returned by claimHost when another server has the
+	// hostname.
+	ErrHostInUse = errors.New("host in use")
+
+	// errPeeked stops the TLS handshake once we've seen the ClientHello.
+	errPeeked = errors.New("peeked")
+)
+
+// hostListener is a net.Listener for the clients of the shared port that want
+// the hostname it was claimed for.
+type hostListener struct {
+	host      string
+	addr      net.Addr
+	conns     chan net.Conn
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+// claimHost returns a listener for the clients of the shared port that want
+// host. A wildcard like *.example.com gets the clients of every name directly
+// under example.com that isn't claimed itself.
+func claimHost(host string) (*hostListener, error) {
+	host = strings.ToLower(host)
+	hostLock.Lock()
+	defer hostLock.Unlock()
+	if hosts[host] != nil {
+		return nil, ErrHostInUse
+	}
+	l := &hostListener{
+		host:  host,
+		addr:  sharedListener.Addr(),
+		conns: make(chan net.Conn),
+		close: make(chan struct{}),
+	}
+	hosts[host] = l
+	return l, nil
+}
+
+// lookupHost returns the listener for host or nil if nobody claimed it.
+func lookupHost(host string) *hostListener {
+	host = strings.ToLower(host)
+	hostLock.Lock()
+	defer hostLock.Unlock()
+	if l := hosts[host]; l != nil {
+		return l
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		return hosts["*."+parent]
+	}
+	return nil
+}
+
+// Accept implements the net.Listener interface.
+func (l *hostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.close:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close implements the net.Listener interface. It gives up the hostname.
+func (l *hostListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.close)
+		hostLock.Lock()
+		if hosts[l.host] == l {
+			delete(hosts, l.host)
+		}
+		hostLock.Unlock()
+	})
+	return nil
+}
+
+// Addr implements the net.Listener interface. It returns the shared port's
+// address.
+func (l *hostListener) Addr() net.Addr {
+	return l.addr
+}
+
+// serveShared accepts clients on the shared port and hands each one to the
+// server that claimed the host it wants.
+func serveShared(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("accepting on the shared port", "err", err)
+			continue
+		}
+		if !publicACL.Load().permits(conn.RemoteAddr()) {
+			slog.Info("client refused by address", "client", conn.RemoteAddr().String())
+			rejectedClients.Add(1)
+			conn.Close()
+			continue
+		}
+		go route(conn)
+	}
+}
+
+// route works out which host conn wants and hands it to that host's listener.
+// The bytes read to find out are given to the server as part of the stream.
+func route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(peekTimeout))
+	pc := &peekedConn{Conn: conn}
+	host, isHTTP, err := pc.host()
+	if err != nil {
+		slog.Info("unable to route client", "client", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	l := lookupHost(host)
+	if l == nil {
+		slog.Info("no server for host", "client", conn.RemoteAddr().String(), "host", host)
+		if isHTTP {
+			io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		}
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- pc:
+	case <-l.close:
+		conn.Close()
+	}
+}
+
+// peekedConn is a client of the shared port. Reads return what was read to
+// find the host before anything else.
+type peekedConn struct {
+	net.Conn
+	peeked bytes.Buffer
+}
+
+// Read implements the net.Conn interface.
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if c.peeked.Len() > 0 {
+		return c.peeked.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+// host reads enough of the stream to find the host the client wants: the SNI
+// of a TLS ClientHello or else the Host header of an HTTP request. isHTTP is
+// set for the latter.
+func (c *peekedConn) host() (host string, isHTTP bool, err error) {
+	r := bufio.NewReader(io.TeeReader(io.LimitReader(c.Conn, maxPeek), &c.peeked))
+	first, err := r.Peek(1)
+	if err != nil {
+		return "", false, err
+	}
+	// Every TLS connection starts with a handshake record.
+	if first[0] == 0x16 {
+		var hello *tls.ClientHelloInfo
+		tc := tls.Server(readOnlyConn{c.Conn, r}, &tls.Config{
+			GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello = h
+				return nil, errPeeked
+			},
+		})
+		tc.Handshake()
+		if hello == nil {
+			return "", false, errors.New("no TLS ClientHello")
+		}
+		if hello.ServerName == "" {
+			return "", false, errors.New("no SNI in the TLS ClientHello")
+		}
+		return hello.ServerName, false, nil
+	}
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", true, fmt.Errorf("reading HTTP request: %w", err)
+	}
+	host = req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		return "", true, errors.New("no Host in the HTTP request")
+	}
+	return host, true, nil
+}
+
+// readOnlyConn lets the TLS handshake read the ClientHello but not answer it.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error) { return 0, io.ErrClosedPipe }